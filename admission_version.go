@@ -0,0 +1,73 @@
+package amp
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// decodeAdmissionReview decodes an admission.k8s.io/v1 or v1beta1
+// AdmissionReview, converting v1beta1 to v1. The returned
+// GroupVersion is the version received so the response can be sent
+// back in the same version.
+func decodeAdmissionReview(raw []byte) (admissionv1.AdmissionReview, schema.GroupVersion, error) {
+	review := admissionv1.AdmissionReview{}
+
+	deserializer := codecs.UniversalDeserializer()
+	obj, gvk, err := deserializer.Decode(raw, nil, nil)
+	if err != nil {
+		return review, admissionv1.SchemeGroupVersion, err
+	}
+
+	switch o := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		return *o, admissionv1.SchemeGroupVersion, nil
+	case *admissionv1beta1.AdmissionReview:
+		if o.Request != nil {
+			review.Request = &admissionv1.AdmissionRequest{}
+			if err := convertAdmission(o.Request, review.Request); err != nil {
+				return review, admissionv1beta1.SchemeGroupVersion, err
+			}
+		}
+		return review, admissionv1beta1.SchemeGroupVersion, nil
+	}
+
+	return review, admissionv1.SchemeGroupVersion, fmt.Errorf("unsupported AdmissionReview version %s", gvk)
+}
+
+// encodeAdmissionReview wraps resp in an AdmissionReview of version gv.
+func encodeAdmissionReview(gv schema.GroupVersion, resp *admissionv1.AdmissionResponse) (interface{}, error) {
+	if gv == admissionv1beta1.SchemeGroupVersion {
+		review := admissionv1beta1.AdmissionReview{Response: &admissionv1beta1.AdmissionResponse{}}
+		review.Kind = "AdmissionReview"
+		review.APIVersion = gv.String()
+		if err := convertAdmission(resp, review.Response); err != nil {
+			return nil, err
+		}
+		return review, nil
+	}
+
+	review := admissionv1.AdmissionReview{Response: resp}
+	review.Kind = "AdmissionReview"
+	review.APIVersion = admissionv1.SchemeGroupVersion.String()
+
+	return review, nil
+}
+
+// convertAdmission converts between the v1 and v1beta1 admission
+// request and response types, which share a JSON representation.
+func convertAdmission(in interface{}, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("unable to convert %T: %w", in, err)
+	}
+
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("unable to convert %T to %T: %w", in, out, err)
+	}
+
+	return nil
+}
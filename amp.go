@@ -1,29 +1,49 @@
 package amp
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1beta1"
+	"k8s.io/client-go/tools/cache"
 )
 
 type AdmissionReview string
 
+const (
+	defaultAllowedEpHostsAnnotation        = "amp.txn2.com/allowed-ep-hosts"
+	defaultValidationAggregationAnnotation = "validation.amp.txn2.com/aggregation"
+	defaultPatchAllowAnnotation            = "mutation.amp.txn2.com/patch-allow"
+	defaultPatchDenyAnnotation             = "mutation.amp.txn2.com/patch-deny"
+	defaultPatchViolationAnnotation        = "mutation.amp.txn2.com/patch-violation"
+	defaultFailurePolicyAnnotation         = "amp.txn2.com/failure-policy"
+	defaultEndpointTimeoutAnnotation       = "amp.txn2.com/endpoint-timeout"
+	defaultClientTLSSecretAnnotation       = "amp.txn2.com/client-tls-secret"
+	defaultSigningSecretAnnotation         = "amp.txn2.com/signing-secret"
+	defaultTokenAudienceAnnotation         = "amp.txn2.com/token-audience"
+)
+
 const (
 	AdmissionReviewValidate AdmissionReview = "validate"
 	AdmissionReviewMutate   AdmissionReview = "mutate"
@@ -36,10 +56,130 @@ type Config struct {
 	Cs                     *kubernetes.Clientset
 	MutationEpAnnotation   string
 	ValidationEpAnnotation string
+
+	// NamespaceResync is the resync period of the namespace informer,
+	// defaults to 10 minutes.
+	NamespaceResync time.Duration
+
+	// CacheSyncTimeout bounds the initial namespace cache sync performed
+	// by NewApi, defaults to 30 seconds.
+	CacheSyncTimeout time.Duration
+
+	// PodEpOverride lets the object under review select its own endpoint
+	// with MutationEpAnnotation or ValidationEpAnnotation, limited to the
+	// hosts its Namespace lists in AllowedEpHostsAnnotation.
+	PodEpOverride            bool
+	AllowedEpHostsAnnotation string
+
+	// ValidationAggregation decides how many of a namespace's validation
+	// endpoints must allow an object, defaults to AggregationAll. The
+	// namespace may override it with ValidationAggregationAnnotation.
+	ValidationAggregation           Aggregation
+	ValidationAggregationAnnotation string
+
+	// PatchPolicy restricts the paths mutation patches may modify. A
+	// namespace may add to it with PatchAllowAnnotation and
+	// PatchDenyAnnotation and choose the action taken on violations
+	// with PatchViolationAnnotation.
+	PatchPolicy              PatchPolicy
+	PatchAllowAnnotation     string
+	PatchDenyAnnotation      string
+	PatchViolationAnnotation string
+
+	// FailurePolicy decides whether endpoint failures deny (Fail) or
+	// allow (Ignore) the admission request, per failure class. A
+	// namespace may override it with FailurePolicyAnnotation, see
+	// ParseFailurePolicy. The zero value fails validation and ignores
+	// mutation failures.
+	FailurePolicy           FailurePolicy
+	FailurePolicyAnnotation string
+
+	// Retry retries failed endpoint calls, the zero value calls each
+	// endpoint once.
+	Retry RetryPolicy
+
+	// WebhookTimeout is the timeoutSeconds of the webhook
+	// configuration. Endpoint calls, including retries, must finish
+	// within it. It is only used when the API server does not send the
+	// timeout with the request, defaults to 10 seconds.
+	WebhookTimeout time.Duration
+
+	// EndpointTimeout bounds each endpoint call attempt, when zero an
+	// attempt may use the remainder of the webhook timeout. A namespace
+	// may override it with EndpointTimeoutAnnotation and an endpoint
+	// with its timeout option.
+	EndpointTimeout           time.Duration
+	EndpointTimeoutAnnotation string
+
+	// CircuitBreaker opens the circuit of failing endpoints so calls to
+	// them fail immediately per the failure policy instead of waiting
+	// for the endpoint timeout. The zero value disables it.
+	CircuitBreaker CircuitPolicy
+
+	// ClientCA and ClientCert are the CA bundle trusted and the key
+	// pair presented by endpoint calls, see NewClientTransport for
+	// HttpClient. A namespace may reference a Secret in it with
+	// ClientTLSSecretAnnotation holding its own ca.crt, tls.crt and
+	// tls.key. Clients for those namespaces use NewTransport, defaults
+	// to a clone of http.DefaultTransport dialing with Egress.
+	ClientCA                  *CertPoolReloader
+	ClientCert                *KeypairReloader
+	ClientTLSSecretAnnotation string
+	NewTransport              func(*tls.Config) http.RoundTripper
+
+	// SigningSecretAnnotation names the namespace annotation
+	// referencing a Secret in it with a signing-key. Endpoint calls of
+	// the namespace are signed with the key, see SignatureVerifier.
+	SigningSecretAnnotation string
+
+	// TokenAudience requests a bearer token for the audience from the
+	// TokenTransport of HttpClient for every endpoint call, none when
+	// empty. A namespace may choose its own audience with
+	// TokenAudienceAnnotation when it matches one of the
+	// AllowedTokenAudiences glob patterns, in which "{namespace}" is
+	// replaced with the name of the namespace.
+	TokenAudience           string
+	TokenAudienceAnnotation string
+	AllowedTokenAudiences   []string
+
+	// Egress restricts the schemes, hosts and addresses endpoint calls
+	// may use. Addresses are only checked by transports dialing with
+	// Egress.Dialer, the zero value permits every endpoint.
+	Egress EgressPolicy
+
+	// Redaction masks sensitive fields of the objects under review in
+	// logs, and strips them from the payload of endpoints with the
+	// minimal payload option. The zero value redacts nothing.
+	Redaction RedactionPolicy
+
+	// ServiceEndpointSlices calls endpoints given as a Service straight
+	// at a ready endpoint of the Service, found with the EndpointSlice
+	// API, rather than through the Service address. Their transports
+	// must dial with ServiceDialContext.
+	ServiceEndpointSlices bool
+
+	// SecretRefresh is how long Secrets referenced by namespace
+	// annotations are cached, defaults to one minute.
+	SecretRefresh time.Duration
+
+	// EndpointResolver resolves the endpoints admission requests are
+	// forwarded to, defaults to a NamespaceAnnotationResolver using
+	// the annotation settings above.
+	EndpointResolver EndpointResolver
 }
 
 type Api struct {
 	*Config
+
+	informerFactory informers.SharedInformerFactory
+	nsLister        corelisters.NamespaceLister
+	nsSynced        cache.InformerSynced
+	svcLister       corelisters.ServiceLister
+	sliceLister     discoverylisters.EndpointSliceLister
+	stopCh          chan struct{}
+	circuits        *circuits
+	secrets         secretCache
+	nsClients       namespaceClients
 }
 
 var scheme = runtime.NewScheme()
@@ -52,17 +192,10 @@ func init() {
 func addToScheme(scheme *runtime.Scheme) {
 	utilruntime.Must(corev1.AddToScheme(scheme))
 	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(scheme))
 	utilruntime.Must(admissionregistrationv1.AddToScheme(scheme))
 }
 
-// PatchOperation
-// see: http://jsonpatch.com/
-type PatchOperation struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
-}
-
 func NewApi(cfg *Config) (*Api, error) {
 	a := &Api{Config: cfg}
 
@@ -86,18 +219,124 @@ func NewApi(cfg *Config) (*Api, error) {
 		return nil, errors.New("no Kubernetes Client Set specified")
 	}
 
+	if a.NamespaceResync == 0 {
+		a.NamespaceResync = defaultNamespaceResync
+	}
+
+	if a.CacheSyncTimeout == 0 {
+		a.CacheSyncTimeout = defaultCacheSyncTimeout
+	}
+
+	a.stopCh = make(chan struct{})
+	a.startInformers()
+
+	if a.AllowedEpHostsAnnotation == "" {
+		a.AllowedEpHostsAnnotation = defaultAllowedEpHostsAnnotation
+	}
+
+	if a.ValidationAggregation == "" {
+		a.ValidationAggregation = AggregationAll
+	}
+
+	if a.ValidationAggregationAnnotation == "" {
+		a.ValidationAggregationAnnotation = defaultValidationAggregationAnnotation
+	}
+
+	if a.PatchAllowAnnotation == "" {
+		a.PatchAllowAnnotation = defaultPatchAllowAnnotation
+	}
+
+	if a.PatchDenyAnnotation == "" {
+		a.PatchDenyAnnotation = defaultPatchDenyAnnotation
+	}
+
+	if a.PatchViolationAnnotation == "" {
+		a.PatchViolationAnnotation = defaultPatchViolationAnnotation
+	}
+
+	if a.FailurePolicyAnnotation == "" {
+		a.FailurePolicyAnnotation = defaultFailurePolicyAnnotation
+	}
+
+	if a.WebhookTimeout == 0 {
+		a.WebhookTimeout = defaultWebhookTimeout
+	}
+
+	if a.EndpointTimeoutAnnotation == "" {
+		a.EndpointTimeoutAnnotation = defaultEndpointTimeoutAnnotation
+	}
+
+	if a.CircuitBreaker.MinRequests == 0 {
+		a.CircuitBreaker.MinRequests = defaultCircuitMinRequests
+	}
+
+	if a.CircuitBreaker.Window == 0 {
+		a.CircuitBreaker.Window = defaultCircuitWindow
+	}
+
+	if a.CircuitBreaker.OpenDuration == 0 {
+		a.CircuitBreaker.OpenDuration = defaultCircuitOpenDuration
+	}
+
+	a.circuits = newCircuits(a.CircuitBreaker)
+
+	if a.ClientTLSSecretAnnotation == "" {
+		a.ClientTLSSecretAnnotation = defaultClientTLSSecretAnnotation
+	}
+
+	if a.SigningSecretAnnotation == "" {
+		a.SigningSecretAnnotation = defaultSigningSecretAnnotation
+	}
+
+	if a.TokenAudienceAnnotation == "" {
+		a.TokenAudienceAnnotation = defaultTokenAudienceAnnotation
+	}
+
+	if a.SecretRefresh == 0 {
+		a.SecretRefresh = defaultSecretRefresh
+	}
+
+	if a.NewTransport == nil {
+		a.NewTransport = a.defaultNewTransport
+	}
+
+	a.secrets.m = map[string]*cachedSecret{}
+	a.nsClients.m = map[string]*namespaceClient{}
+
+	if a.EndpointResolver == nil {
+		a.EndpointResolver = &NamespaceAnnotationResolver{
+			Namespaces:             a,
+			MutationEpAnnotation:   a.MutationEpAnnotation,
+			ValidationEpAnnotation: a.ValidationEpAnnotation,
+			PodOverride:            a.PodEpOverride,
+			AllowedHostsAnnotation: a.AllowedEpHostsAnnotation,
+		}
+	}
+
 	return a, nil
 }
 
+// Close stops the informers started by NewApi.
+func (a *Api) Close() {
+	close(a.stopCh)
+}
+
 func (a *Api) AdmissionReviewHandler(admissionReview AdmissionReview) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		a.Log.Info("AdmissionReview request", zap.Any("type", admissionReview))
 
+		// endpoint calls must finish before the API server gives up on
+		// the webhook, and are abandoned when it cancels the request
+		ctx, cancel := context.WithDeadlineCause(c.Request.Context(),
+			requestDeadline(time.Now(), a.webhookTimeout(c.Request)), errWebhookDeadline)
+		defer cancel()
+
 		rs, err := c.GetRawData()
 		if err != nil {
 			a.Log.Error("AdmissionReviewHandler is unable to parse request body",
 				zap.Error(err),
-				zap.ByteString("raw_data", rs))
+				zap.Int("raw_data_bytes", len(rs)),
+				zap.ByteString("raw_data", a.Redaction.redactReview(rs)))
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"message": "unable to parse request body",
 				"error":   err.Error(),
@@ -118,326 +357,344 @@ func (a *Api) AdmissionReviewHandler(admissionReview AdmissionReview) gin.Handle
 
 		a.Log.Info("Handling AdmissionReview request", zap.Any("type", admissionReview))
 
-		// The AdmissionReview that was sent to the web hook
-		requestedAdmissionReview := admissionv1.AdmissionReview{}
+		// The AdmissionReview that was sent to the web hook, v1beta1
+		// reviews are converted to v1 and answered in v1beta1
+		requestedAdmissionReview, reviewVersion, err := decodeAdmissionReview(rs)
 
 		// The AdmissionReview that will be returned
 		responseAdmissionReview := admissionv1.AdmissionReview{}
 
-		deserializer := codecs.UniversalDeserializer()
-		if _, _, err := deserializer.Decode(rs, nil, &requestedAdmissionReview); err != nil {
+		if err != nil {
 			a.Log.Error("decode error", zap.Error(err))
 			responseAdmissionReview.Response = toAdmissionResponse(err)
+		} else if requestedAdmissionReview.Request == nil {
+			a.Log.Error("AdmissionReview has no request")
+			responseAdmissionReview.Response = toAdmissionResponse(errors.New("AdmissionReview has no request"))
 		} else {
 			// mutate
 			if admissionReview == AdmissionReviewMutate {
-				responseAdmissionReview.Response = a.mutatePod(requestedAdmissionReview)
+				responseAdmissionReview.Response = a.mutatePod(ctx, requestedAdmissionReview)
 			}
 
 			// validate
 			if admissionReview == AdmissionReviewValidate {
-				responseAdmissionReview.Response = a.validatePod(requestedAdmissionReview)
+				responseAdmissionReview.Response = a.validatePod(ctx, requestedAdmissionReview)
 			}
 		}
 
+		if responseAdmissionReview.Response == nil {
+			responseAdmissionReview.Response = toAdmissionResponse(errors.New("no response for admission review"))
+		}
+
+		if err := c.Request.Context().Err(); err != nil {
+			a.Log.Warn("AdmissionReview abandoned by the API server, response will not be delivered",
+				zap.Any("type", admissionReview),
+				zap.Error(err))
+		}
+
 		// Return the same UID
-		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
-		responseAdmissionReview.Kind = "AdmissionReview"
-		responseAdmissionReview.APIVersion = "admission.k8s.io/v1"
+		if requestedAdmissionReview.Request != nil {
+			responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		}
 
-		a.Log.Info("Returning response to Kubernetes")
-		a.Log.Debug("Response debugging, responseAdmissionReview", zap.ByteString("value", responseAdmissionReview.Response.Patch))
+		a.Log.Info("Returning response to Kubernetes", zap.String("version", reviewVersion.String()))
+		a.Log.Debug("Response debugging, responseAdmissionReview", zap.ByteString("value", a.Redaction.redactPatch(responseAdmissionReview.Response.Patch)))
+
+		review, err := encodeAdmissionReview(reviewVersion, responseAdmissionReview.Response)
+		if err != nil {
+			a.Log.Error("unable to encode AdmissionReview response",
+				zap.String("version", reviewVersion.String()),
+				zap.Error(err))
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"message": "unable to encode AdmissionReview response",
+				"error":   err.Error(),
+			})
+			return
+		}
 
-		c.JSON(http.StatusOK, responseAdmissionReview)
+		c.JSON(http.StatusOK, review)
 	}
 }
 
-// validatePod
-func (a *Api) validatePod(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+// validatePod forwards the object under review to the validation
+// endpoints resolved for it. Despite its name any resource kind is
+// supported.
+func (a *Api) validatePod(ctx context.Context, ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	a.Log.Info("started validatePod admission review",
-		zap.Bool("DryRun", *ar.Request.DryRun),
-		zap.String("Namespace", ar.Request.Namespace))
+		zap.String("Operation", string(ar.Request.Operation)),
+		zap.Boolp("DryRun", ar.Request.DryRun),
+		zap.String("Namespace", ar.Request.Namespace),
+		zap.String("Resource", ar.Request.Resource.String()))
 
 	logInfo := []zap.Field{
 		zap.String("namespace", ar.Request.Namespace),
-		zap.String("annotation", a.MutationEpAnnotation),
+		zap.String("resource", ar.Request.Resource.String()),
+		zap.String("operation", string(ar.Request.Operation)),
 	}
 
 	reviewResponse := admissionv1.AdmissionResponse{}
 
-	// amp is for pods
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		a.Log.Error("unexpected resource",
-			append(logInfo,
-				zap.String("expected", podResource.Resource),
-				zap.String("received", ar.Request.Resource.Resource),
-			)...,
-		)
-		return nil
-	}
+	fp := a.failurePolicy(ctx, ar.Request.Namespace, logInfo)
 
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
-		a.Log.Error("deserializer failure", zap.Error(err))
+	obj, err := reviewObject(ar.Request)
+	if err != nil {
+		a.Log.Error("deserializer failure", append(logInfo, zap.Error(err))...)
+		reviewResponse.Allowed = a.failure(AdmissionReviewValidate, fp, &EndpointError{Class: FailureResolution, Err: err}, &reviewResponse, logInfo)
 		return &reviewResponse
 	}
-	logInfo = append(logInfo, zap.String("Pod", pod.Name))
+	logInfo = append(logInfo,
+		zap.String("kind", obj.GetKind()),
+		zap.String("name", obj.GetName()),
+	)
 
-	a.Log.Info("Pod for validation review",
+	a.Log.Info("Object for validation review",
 		append(logInfo,
-			zap.Any("PodLabels", pod.Labels),
-			zap.Any("PodAnnotations", pod.Annotations),
-			zap.Any("PodNamespace", pod.Namespace),
+			zap.Any("Labels", a.Redaction.redactMetadata("labels", obj.GetLabels())),
+			zap.Any("Annotations", a.Redaction.redactMetadata("annotations", obj.GetAnnotations())),
 		)...,
 	)
 
-	ns, err := a.Cs.CoreV1().Namespaces().Get(context.TODO(), ar.Request.Namespace, metav1.GetOptions{})
+	eps, err := a.EndpointResolver.Resolve(ctx, AdmissionReviewValidate, ar.Request, obj)
 	if err != nil {
-		a.Log.Error("unable to get namespace",
+		a.Log.Error("unable to resolve validation endpoint",
 			append(logInfo, zap.Error(err))...,
 		)
+		reviewResponse.Allowed = a.failure(AdmissionReviewValidate, fp, &EndpointError{Class: FailureResolution, Err: err}, &reviewResponse, logInfo)
 		return &reviewResponse
 	}
 
-	// lookup endpoint by namespace annotation
-	annotations := ns.GetAnnotations()
-	ep, ok := annotations[a.ValidationEpAnnotation]
-	if ok == false {
+	if len(eps) == 0 {
 		a.Log.Warn("DEFAULT ALLOW if no validation endpoint is configured for namespace.", logInfo...)
 		reviewResponse.Allowed = true
 		return &reviewResponse
 	}
 
-	logInfo = append(logInfo,
-		zap.String("endpoint", ep),
-		zap.String("annotation", a.ValidationEpAnnotation),
-	)
-
-	a.Log.Info("got validation endpoint from namespace", logInfo...)
-
-	body, err := json.Marshal(pod)
-	if err != nil {
-		a.Log.Info("unable to marshal pod",
+	if err := a.prepareEndpoints(ctx, ar.Request, eps, logInfo); err != nil {
+		a.Log.Error("unable to prepare validation endpoints",
 			append(logInfo, zap.Error(err))...,
 		)
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{
-			Code:    500,
-			Message: fmt.Sprintf("validatePod is unable to Marshal pod: %s", err.Error()),
-		}
+		reviewResponse.Allowed = a.failure(AdmissionReviewValidate, fp, &EndpointError{Class: FailureResolution, Err: err}, &reviewResponse, logInfo)
 		return &reviewResponse
 	}
 
-	req, err := http.NewRequest("POST", ep, bytes.NewBuffer(body))
-	if err != nil {
-		a.Log.Error("Unable to build NewRequest",
-			append(logInfo, zap.Error(err))...,
-		)
-		reviewResponse.Allowed = false
+	agg := a.aggregation(ctx, ar.Request.Namespace, logInfo)
+
+	logInfo = append(logInfo,
+		zap.Int("endpoints", len(eps)),
+		zap.String("aggregation", string(agg)),
+	)
+
+	// a quorum larger than the endpoints resolved can never be reached
+	if required := agg.required(len(eps)); required > len(eps) {
+		a.Log.Error("validation quorum exceeds the resolved endpoints", logInfo...)
 		reviewResponse.Result = &metav1.Status{
-			Code:    500,
-			Message: fmt.Sprintf("validatePod is unable to build NewRequest: %s", err.Error()),
+			Code:    http.StatusInternalServerError,
+			Message: fmt.Sprintf("validatePod quorum of %d exceeds the %d validation endpoints", required, len(eps)),
 		}
 		return &reviewResponse
 	}
 
-	resp, err := a.HttpClient.Do(req)
-	if err != nil {
-		a.Log.Error("Unable make endpoint request",
-			append(logInfo, zap.Error(err))...,
-		)
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{
-			Code:    500,
-			Message: fmt.Sprintf("validatePod is unable make endpoint request: %s", err.Error()),
-		}
+	a.Log.Info("resolved validation endpoints", logInfo...)
+
+	results := a.callValidationEndpoints(ctx, ar.Request, eps, logInfo)
+
+	votes := a.votes(fp, results, &reviewResponse, logInfo)
+	if len(votes) == 0 {
+		a.Log.Warn("DEFAULT ALLOW if every validation endpoint failure is ignored.", logInfo...)
+		reviewResponse.Allowed = true
 		return &reviewResponse
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		a.Log.Error("Endpoint request returned non-200 response",
-			append(logInfo, zap.Int("http_status_code", resp.StatusCode))...,
-		)
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{
-			Code:    500,
-			Message: fmt.Sprintf("validatePod endpoint returned non-200, got: %v", resp.StatusCode),
+	resp := aggregate(agg.capped(len(votes)), votes)
+	mergeResponseMeta(resp, &reviewResponse)
+
+	return resp
+}
+
+// votes applies the failure policy to the failed validation results
+// and returns the results taking part in the aggregation. An ignored
+// failure drops its endpoint from the vote, only its warning is added
+// to resp.
+func (a *Api) votes(fp FailurePolicy, results []validationResult, resp *admissionv1.AdmissionResponse, logInfo []zap.Field) []validationResult {
+	votes := make([]validationResult, 0, len(results))
+	for i := range results {
+		if results[i].err != nil && a.failure(AdmissionReviewValidate, fp, results[i].err, &results[i].response, logInfo) {
+			mergeResponseMeta(resp, &results[i].response)
+			continue
 		}
-		return &reviewResponse
+		votes = append(votes, results[i])
 	}
 
-	respBody, err := io.ReadAll(resp.Body)
+	return votes
+}
+
+// aggregation returns the validation aggregation annotated on the
+// namespace, or the configured default.
+func (a *Api) aggregation(ctx context.Context, namespace string, logInfo []zap.Field) Aggregation {
+	ns, err := a.GetNamespace(ctx, namespace)
 	if err != nil {
-		a.Log.Error("Error reading response body",
-			append(logInfo, zap.Error(err))...,
-		)
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{
-			Code:    500,
-			Message: fmt.Sprintf("validatePod is unable to read endpoint response body: %s", err.Error()),
-		}
-		return &reviewResponse
+		return a.ValidationAggregation
+	}
+
+	value, ok := ns.GetAnnotations()[a.ValidationAggregationAnnotation]
+	if !ok {
+		return a.ValidationAggregation
 	}
-	_ = resp.Body.Close()
 
-	// unmarshal response body into admissionv1.AdmissionResponse
-	err = json.Unmarshal(respBody, &reviewResponse)
+	agg, err := ParseAggregation(value)
 	if err != nil {
-		a.Log.Error("unable to unmarshal response body into admissionv1.AdmissionResponse",
+		a.Log.Warn("ignoring invalid aggregation annotation",
 			append(logInfo, zap.Error(err))...,
 		)
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{
-			Code:    500,
-			Message: fmt.Sprintf("validatePod is unable to unmarshal response body into admissionv1.AdmissionResponse: %s", err.Error()),
-		}
-		return &reviewResponse
+		return a.ValidationAggregation
 	}
 
-	return &reviewResponse
+	return agg
 }
 
-func (a *Api) mutatePod(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+// mutatePod forwards the object under review through the chain of
+// mutation endpoints resolved for it. Despite its name any resource
+// kind is supported.
+func (a *Api) mutatePod(ctx context.Context, ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	a.Log.Info("started mutatePod admission review",
-		zap.Bool("DryRun", *ar.Request.DryRun),
-		zap.String("Namespace", ar.Request.Namespace))
+		zap.String("Operation", string(ar.Request.Operation)),
+		zap.Boolp("DryRun", ar.Request.DryRun),
+		zap.String("Namespace", ar.Request.Namespace),
+		zap.String("Resource", ar.Request.Resource.String()))
 
 	logInfo := []zap.Field{
 		zap.String("namespace", ar.Request.Namespace),
-		zap.String("annotation", a.MutationEpAnnotation),
+		zap.String("resource", ar.Request.Resource.String()),
+		zap.String("operation", string(ar.Request.Operation)),
 	}
 
 	reviewResponse := admissionv1.AdmissionResponse{}
 	// always allow, mutation happens first, validation can deny if it needs to
 	reviewResponse.Allowed = true
 
-	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		a.Log.Error("unexpected resource",
-			append(logInfo,
-				zap.String("expected", podResource.Resource),
-				zap.String("received", ar.Request.Resource.Resource),
-			)...,
-		)
-		return nil
+	// there is nothing to patch on DELETE and CONNECT
+	if ar.Request.Operation == admissionv1.Delete || ar.Request.Operation == admissionv1.Connect {
+		a.Log.Info("skipping mutation, operation has no object to patch", logInfo...)
+		return &reviewResponse
 	}
 
-	raw := ar.Request.Object.Raw
-	pod := corev1.Pod{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
-		a.Log.Error("deserializer failure", zap.Error(err))
+	fp := a.failurePolicy(ctx, ar.Request.Namespace, logInfo)
+
+	obj, err := reviewObject(ar.Request)
+	if err != nil {
+		a.Log.Error("deserializer failure", append(logInfo, zap.Error(err))...)
+		a.failure(AdmissionReviewMutate, fp, &EndpointError{Class: FailureResolution, Err: err}, &reviewResponse, logInfo)
 		return &reviewResponse
 	}
-	logInfo = append(logInfo, zap.String("Pod", pod.Name))
+	logInfo = append(logInfo,
+		zap.String("kind", obj.GetKind()),
+		zap.String("name", obj.GetName()),
+	)
 
-	a.Log.Info("Pod for mutation review",
+	a.Log.Info("Object for mutation review",
 		append(logInfo,
-			zap.Any("PodLabels", pod.Labels),
-			zap.Any("PodAnnotations", pod.Annotations),
-			zap.Any("PodNamespace", pod.Namespace),
+			zap.Any("Labels", a.Redaction.redactMetadata("labels", obj.GetLabels())),
+			zap.Any("Annotations", a.Redaction.redactMetadata("annotations", obj.GetAnnotations())),
 		)...,
 	)
 
-	ns, err := a.Cs.CoreV1().Namespaces().Get(context.TODO(), ar.Request.Namespace, metav1.GetOptions{})
+	eps, err := a.EndpointResolver.Resolve(ctx, AdmissionReviewMutate, ar.Request, obj)
 	if err != nil {
-		a.Log.Error("unable to get namespace",
+		a.Log.Error("unable to resolve mutation endpoint",
 			append(logInfo, zap.Error(err))...,
 		)
+		a.failure(AdmissionReviewMutate, fp, &EndpointError{Class: FailureResolution, Err: err}, &reviewResponse, logInfo)
 		return &reviewResponse
 	}
 
-	// lookup endpoint by namespace annotation
-	annotations := ns.GetAnnotations()
-	ep, ok := annotations[a.MutationEpAnnotation]
-	if ok == false {
+	if len(eps) == 0 {
 		a.Log.Warn("no endpoint configured for namespace", logInfo...)
 		return &reviewResponse
 	}
 
-	logInfo = append(logInfo,
-		zap.String("endpoint", ep),
-		zap.String("annotation", a.MutationEpAnnotation),
-	)
-
-	a.Log.Info("got endpoint from namespace", logInfo...)
+	current := ar.Request.Object.Raw
 
-	body, err := json.Marshal(pod)
-	if err != nil {
-		a.Log.Info("unable to marshal pod",
+	if err := a.prepareEndpoints(ctx, ar.Request, eps, logInfo); err != nil {
+		a.Log.Error("unable to prepare mutation endpoints",
 			append(logInfo, zap.Error(err))...,
 		)
+		a.failure(AdmissionReviewMutate, fp, &EndpointError{Class: FailureResolution, Err: err}, &reviewResponse, logInfo)
 		return &reviewResponse
 	}
 
-	req, err := http.NewRequest("POST", ep, bytes.NewBuffer(body))
-	if err != nil {
-		a.Log.Error("Unable to build NewRequest",
-			append(logInfo, zap.Error(err))...,
+	policy := a.patchPolicy(ctx, ar.Request.Namespace, logInfo)
+
+	// call each endpoint in order, applying its patch before sending
+	// the object to the next one; the combined patch is the concatenation
+	// of every applied patch
+	var combined jsonpatch.Patch
+	for i, ep := range eps {
+		epLog := append(logInfo[:len(logInfo):len(logInfo)],
+			zap.Int("chain_index", i),
+			zap.String("endpoint", ep.URL),
+			zap.String("source", ep.Source),
 		)
-		return &reviewResponse
-	}
 
-	resp, err := a.HttpClient.Do(req)
-	if err != nil {
-		a.Log.Error("Unable make endpoint request",
-			append(logInfo, zap.Error(err))...,
-		)
-		return &reviewResponse
-	}
+		a.Log.Info("calling mutation endpoint", epLog...)
 
-	if resp.StatusCode != http.StatusOK {
-		a.Log.Error("Endpoint request returned non-200 response",
-			append(logInfo, zap.Int("http_status_code", resp.StatusCode))...,
-		)
-		return &reviewResponse
+		patch, patched, err := a.mutateWith(ctx, ep, ar.Request, current, policy, &reviewResponse, epLog)
+		if err != nil {
+			if a.failure(AdmissionReviewMutate, fp, err, &reviewResponse, epLog) {
+				continue
+			}
+			return &reviewResponse
+		}
+
+		if !reviewResponse.Allowed {
+			return &reviewResponse
+		}
+
+		current = patched
+		combined = append(combined, patch...)
 	}
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		a.Log.Error("Error reading response body",
-			append(logInfo, zap.Error(err))...,
-		)
+	if len(combined) == 0 {
 		return &reviewResponse
 	}
-	_ = resp.Body.Close()
-
-	var po []PatchOperation
-
-	// example patch operation
-	// see: http://jsonpatch.com/
-	//
-	//po := []PatchOperation{
-	//	{
-	//		Op:   "add",
-	//		Path: "/spec/initContainers",
-	//		Value: corev1.Container{
-	//			Name:  "added-init-container",
-	//			Image: "alpine:3.12.0",
-	//		},
-	//	},
-	//}
-
-	// Ensure that the response body is a PatchOperation
-	// TODO: Validate PatchOperation
-	err = json.Unmarshal(respBody, &po)
+
+	patch, err := json.Marshal(combined)
 	if err != nil {
-		a.Log.Error("Error unmarshalling response body into PatchOperation",
+		a.Log.Error("unable to marshal combined patch",
 			append(logInfo, zap.Error(err))...,
 		)
 		return &reviewResponse
 	}
 
-	reviewResponse.Patch = respBody
+	reviewResponse.Patch = patch
 	pt := admissionv1.PatchTypeJSONPatch
 	reviewResponse.PatchType = &pt
 
 	return &reviewResponse
 }
 
+// decodeObject decodes raw into an Unstructured object.
+func decodeObject(raw []byte) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// mergeResponseMeta adds the warnings and audit annotations of src to
+// dst.
+func mergeResponseMeta(dst *admissionv1.AdmissionResponse, src *admissionv1.AdmissionResponse) {
+	for k, v := range src.AuditAnnotations {
+		if dst.AuditAnnotations == nil {
+			dst.AuditAnnotations = map[string]string{}
+		}
+		dst.AuditAnnotations[k] = v
+	}
+
+	dst.Warnings = append(dst.Warnings, src.Warnings...)
+}
+
 // toAdmissionResponse is a helper function to create an AdmissionResponse
 // with an embedded error see:
 // https://github.com/kubernetes/kubernetes/tree/v1.15.0/test/images/webhook
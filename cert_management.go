@@ -1,23 +1,49 @@
 package amp
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 )
 
 // From
 // https://stackoverflow.com/a/40883377/265026
 
+// keypairReloadDelay collects the file events of a single update,
+// such as the symlink swap of a Kubernetes Secret volume, into one
+// reload.
+const keypairReloadDelay = 100 * time.Millisecond
+
+// KeypairReloader holds a TLS key pair loaded from PEM files. It is
+// reloaded when the files or the directories holding them change,
+// which includes the ..data symlink swap of Kubernetes Secret volumes,
+// on SIGHUP and when the certificate is about to expire. A new pair
+// only replaces the current one if the key matches the certificate
+// and the certificate is valid. Close stops reloading.
 type KeypairReloader struct {
 	logger   *zap.Logger
 	certMu   sync.RWMutex
 	cert     *tls.Certificate
+	certPEM  []byte
+	keyPEM   []byte
 	certPath string
 	keyPath  string
+
+	watcher   *fsnotify.Watcher
+	signals   chan os.Signal
+	stopCh    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 func NewKeypairReloader(certPath, keyPath string, logger *zap.Logger) (*KeypairReloader, error) {
@@ -25,52 +51,121 @@ func NewKeypairReloader(certPath, keyPath string, logger *zap.Logger) (*KeypairR
 		logger:   logger,
 		certPath: certPath,
 		keyPath:  keyPath,
+		signals:  make(chan os.Signal, 1),
+		stopCh:   make(chan struct{}),
 	}
 
 	logger.Info("NewKeypairReloader loading",
 		zap.String("certPath", certPath),
 		zap.String("keyPath", keyPath))
 
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if _, err := kpr.maybeReload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := kpr.watch()
+	if err != nil {
+		logger.Warn("Unable to watch TLS certificate and key, reloading on SIGHUP and expiry only",
+			zap.String("certPath", certPath),
+			zap.String("keyPath", keyPath),
+			zap.Error(err))
+	}
+	kpr.watcher = watcher
+
+	signal.Notify(kpr.signals, syscall.SIGHUP)
+
+	kpr.wg.Add(2)
+	go kpr.certExpChecker()
+	go kpr.reloader()
+
+	return kpr, nil
+}
+
+// watch watches the directories holding the certificate and key.
+// Watching the files themselves would miss updates that replace them.
+func (kpr *KeypairReloader) watch() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 
-	kpr.cert = &cert
-	go func() {
-		err := kpr.certExpChecker()
-		if err != nil {
-			kpr.logger.Fatal("certExpChecker",
-				zap.String("certPath", certPath),
-				zap.String("keyPath", keyPath),
-				zap.Error(err),
-			)
+	for _, dir := range []string{filepath.Dir(kpr.certPath), filepath.Dir(kpr.keyPath)} {
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, err
 		}
-	}()
-
-	//go func() {
-	//	c := make(chan os.Signal, 1)
-	//	signal.Notify(c, syscall.SIGHUP)
-	//	for range c {
-	//		logger.Info("Reloading TLS certificate and key",
-	//			zap.String("cert", certPath), zap.String("key", keyPath))
-	//		if err := result.maybeReload(); err != nil {
-	//			logger.Error("Keeping old TLS certificate because the new one could not be loaded", zap.Error(err))
-	//		}
-	//	}
-	//}()
-	return kpr, nil
+	}
+
+	return watcher, nil
 }
 
-func (kpr *KeypairReloader) certExpChecker() error {
+// reloader reloads the key pair on file events and SIGHUP until Close.
+func (kpr *KeypairReloader) reloader() {
+	defer kpr.wg.Done()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if kpr.watcher != nil {
+		events, errs = kpr.watcher.Events, kpr.watcher.Errors
+	}
+
+	delay := time.NewTimer(keypairReloadDelay)
+	delay.Stop()
+	defer delay.Stop()
+
 	for {
-		// Parse the certificate data
-		parsedCert, err := x509.ParseCertificate(kpr.cert.Certificate[0])
-		if err != nil {
-			return err
+		select {
+		case <-kpr.stopCh:
+			return
+		case <-kpr.signals:
+			kpr.logger.Info("Reloading TLS certificate and key on SIGHUP",
+				zap.String("cert", kpr.certPath), zap.String("key", kpr.keyPath))
+			kpr.reload()
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) != 0 {
+				delay.Reset(keypairReloadDelay)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			kpr.logger.Warn("TLS certificate watch error", zap.Error(err))
+		case <-delay.C:
+			kpr.reload()
 		}
-		now := time.Now()
-		expSecs := parsedCert.NotAfter.Unix() - now.Unix()
+	}
+}
+
+// reload reloads the key pair, keeping the current one on failure.
+func (kpr *KeypairReloader) reload() {
+	changed, err := kpr.maybeReload()
+	if err != nil {
+		kpr.logger.Error("Keeping old TLS certificate because the new one could not be loaded",
+			zap.String("certPath", kpr.certPath),
+			zap.String("keyPath", kpr.keyPath),
+			zap.Error(err))
+		return
+	}
+
+	if changed {
+		kpr.logger.Info("Reloaded TLS certificate",
+			zap.String("certPath", kpr.certPath),
+			zap.Time("notAfter", kpr.leaf().NotAfter))
+	}
+}
+
+// certExpChecker reloads the key pair when the certificate is about to
+// expire, in case its update was missed.
+func (kpr *KeypairReloader) certExpChecker() {
+	defer kpr.wg.Done()
+
+	for {
+		expSecs := kpr.leaf().NotAfter.Unix() - time.Now().Unix()
 
 		kpr.logger.Info("Checking cert",
 			zap.Int64("expiresInSec", expSecs))
@@ -81,10 +176,7 @@ func (kpr *KeypairReloader) certExpChecker() error {
 				zap.Int64("expiresInSec", expSecs),
 			)
 
-			if err := kpr.maybeReload(); err != nil {
-				kpr.logger.Error("Keeping old TLS certificate because the new one could not be loaded",
-					zap.Error(err))
-			}
+			kpr.reload()
 		}
 
 		// if expSecs < 600 then wait 10 seconds between checks
@@ -99,25 +191,108 @@ func (kpr *KeypairReloader) certExpChecker() error {
 			zap.Int64("expiresInSec", expSecs),
 			zap.Duration("waitTime", waitTime))
 
-		time.Sleep(waitTime)
+		timer := time.NewTimer(waitTime)
+		select {
+		case <-timer.C:
+		case <-kpr.stopCh:
+			timer.Stop()
+			return
+		}
 	}
 }
 
-func (kpr *KeypairReloader) maybeReload() error {
+// maybeReload loads the key pair and reports whether it changed. The
+// current pair is kept if the files are unchanged, the key does not
+// match the certificate or the certificate is not valid now. The
+// first pair loaded is only required to match.
+func (kpr *KeypairReloader) maybeReload() (bool, error) {
+	certPEM, err := os.ReadFile(kpr.certPath)
+	if err != nil {
+		return false, err
+	}
+
+	keyPEM, err := os.ReadFile(kpr.keyPath)
+	if err != nil {
+		return false, err
+	}
+
+	kpr.certMu.RLock()
+	unchanged := bytes.Equal(certPEM, kpr.certPEM) && bytes.Equal(keyPEM, kpr.keyPEM)
+	kpr.certMu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
 	kpr.logger.Info("Attempting certificate reload",
 		zap.String("certPath", kpr.certPath),
 		zap.String("keyPath", kpr.keyPath),
 	)
-	newCert, err := tls.LoadX509KeyPair(kpr.certPath, kpr.keyPath)
+
+	// X509KeyPair fails when the key does not match the certificate
+	newCert, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
-		return err
+		return false, err
 	}
+
+	leaf, err := x509.ParseCertificate(newCert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+
+	newCert.Leaf = leaf
+
 	kpr.certMu.Lock()
 	defer kpr.certMu.Unlock()
-	kpr.cert = &newCert
+
+	if err := certificateValid(leaf, time.Now()); err != nil {
+		if kpr.cert != nil {
+			return false, err
+		}
+		kpr.logger.Warn("Loaded TLS certificate is not valid",
+			zap.String("certPath", kpr.certPath),
+			zap.Error(err))
+	}
+
+	kpr.cert, kpr.certPEM, kpr.keyPEM = &newCert, certPEM, keyPEM
+
+	return true, nil
+}
+
+// certificateValid returns an error when cert is expired or not yet
+// valid at now.
+func certificateValid(cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter)
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", cert.NotBefore)
+	}
+
 	return nil
 }
 
+// leaf returns the current certificate.
+func (kpr *KeypairReloader) leaf() *x509.Certificate {
+	kpr.certMu.RLock()
+	defer kpr.certMu.RUnlock()
+	return kpr.cert.Leaf
+}
+
+// Close stops reloading the key pair, the current pair remains in use.
+func (kpr *KeypairReloader) Close() error {
+	var err error
+	kpr.closeOnce.Do(func() {
+		signal.Stop(kpr.signals)
+		close(kpr.stopCh)
+		if kpr.watcher != nil {
+			err = kpr.watcher.Close()
+		}
+		kpr.wg.Wait()
+	})
+
+	return err
+}
+
 func (kpr *KeypairReloader) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		kpr.certMu.RLock()
@@ -125,3 +300,11 @@ func (kpr *KeypairReloader) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tl
 		return kpr.cert, nil
 	}
 }
+
+func (kpr *KeypairReloader) GetClientCertificateFunc() func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(certRequest *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		kpr.certMu.RLock()
+		defer kpr.certMu.RUnlock()
+		return kpr.cert, nil
+	}
+}
@@ -0,0 +1,308 @@
+package amp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CircuitState is the state of an endpoint's circuit breaker.
+type CircuitState string
+
+const (
+	// CircuitClosed calls the endpoint.
+	CircuitClosed CircuitState = "closed"
+
+	// CircuitOpen fails calls to the endpoint without making them.
+	CircuitOpen CircuitState = "open"
+
+	// CircuitHalfOpen lets a single probe call through, its outcome
+	// closes or re-opens the circuit.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+const (
+	defaultCircuitMinRequests  = 10
+	defaultCircuitWindow       = time.Minute
+	defaultCircuitOpenDuration = 30 * time.Second
+)
+
+// circuitIdleTimeout is how long a closed circuit is kept without
+// calls, checked at most every circuitSweepInterval.
+const (
+	circuitIdleTimeout   = 10 * time.Minute
+	circuitSweepInterval = time.Minute
+)
+
+// errCircuitOpen is the transport failure returned for calls to an
+// endpoint with an open circuit.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitPolicy opens an endpoint's circuit after ConsecutiveFailures
+// failed calls in a row, or when FailureRate of at least MinRequests
+// calls within Window failed. An open circuit fails calls with a
+// transport failure for OpenDuration, then lets a probe call through.
+// Only transport and status failures count. MinRequests, Window and
+// OpenDuration default to 10, one minute and 30 seconds. Without
+// ConsecutiveFailures or FailureRate circuit breaking is disabled.
+type CircuitPolicy struct {
+	ConsecutiveFailures int
+	FailureRate         float64
+	MinRequests         int
+	Window              time.Duration
+	OpenDuration        time.Duration
+}
+
+func (cp CircuitPolicy) enabled() bool {
+	return cp.ConsecutiveFailures > 0 || cp.FailureRate > 0
+}
+
+// CircuitStatus reports the circuit breaker of an endpoint.
+type CircuitStatus struct {
+	Endpoint            string       `json:"endpoint"`
+	State               CircuitState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Requests            int          `json:"requests"`
+	Failures            int          `json:"failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+type circuit struct {
+	state       CircuitState
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+	lastUsed    time.Time
+}
+
+// circuits holds the circuit breakers of every endpoint called, keyed
+// by circuitKey. Closed circuits without calls for circuitIdleTimeout
+// are evicted, so endpoints annotated once do not accumulate.
+type circuits struct {
+	policy CircuitPolicy
+
+	mu        sync.Mutex
+	m         map[string]*circuit
+	lastSweep time.Time
+}
+
+func newCircuits(policy CircuitPolicy) *circuits {
+	return &circuits{policy: policy, m: map[string]*circuit{}, lastSweep: time.Now()}
+}
+
+// circuitKey returns the circuit of an endpoint URL, its scheme, host
+// and port. Endpoints on the same server share a circuit whatever
+// their path, query or credentials, which bounds the circuits and
+// their metric labels to the servers called.
+func circuitKey(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// allow reports whether a call to endpoint may be made. A true result
+// must be followed by a call to record or release.
+func (cs *circuits) allow(endpoint string) bool {
+	if !cs.policy.enabled() {
+		return true
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.sweep()
+
+	c := cs.get(endpoint)
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < cs.policy.OpenDuration {
+			return false
+		}
+		cs.set(endpoint, c, CircuitHalfOpen)
+		c.probing = true
+		return true
+	case CircuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+
+	return true
+}
+
+// record counts the outcome of a call to endpoint.
+func (cs *circuits) record(endpoint string, failed bool) {
+	if !cs.policy.enabled() {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.get(endpoint)
+	now := time.Now()
+
+	if c.state == CircuitHalfOpen {
+		c.probing = false
+		if failed {
+			c.openedAt = now
+			cs.set(endpoint, c, CircuitOpen)
+			return
+		}
+		c.consecutive, c.requests, c.failures, c.windowStart = 0, 0, 0, now
+		cs.set(endpoint, c, CircuitClosed)
+		return
+	}
+
+	if cs.policy.Window > 0 && now.Sub(c.windowStart) > cs.policy.Window {
+		c.requests, c.failures, c.windowStart = 0, 0, now
+	}
+
+	c.requests++
+	if !failed {
+		c.consecutive = 0
+		return
+	}
+	c.consecutive++
+	c.failures++
+
+	tripped := cs.policy.ConsecutiveFailures > 0 && c.consecutive >= cs.policy.ConsecutiveFailures
+	if cs.policy.FailureRate > 0 && c.requests >= cs.policy.MinRequests &&
+		float64(c.failures)/float64(c.requests) >= cs.policy.FailureRate {
+		tripped = true
+	}
+
+	if tripped && c.state == CircuitClosed {
+		c.openedAt = now
+		cs.set(endpoint, c, CircuitOpen)
+	}
+}
+
+// release ends a call to endpoint without counting its outcome, a
+// half-open circuit lets another probe through.
+func (cs *circuits) release(endpoint string) {
+	if !cs.policy.enabled() {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.get(endpoint).probing = false
+}
+
+// get returns the circuit of endpoint, creating a closed one. cs.mu
+// must be held.
+func (cs *circuits) get(endpoint string) *circuit {
+	now := time.Now()
+
+	c, ok := cs.m[endpoint]
+	if !ok {
+		c = &circuit{state: CircuitClosed, windowStart: now}
+		cs.m[endpoint] = c
+		circuitState.WithLabelValues(endpoint).Set(0)
+	}
+	c.lastUsed = now
+
+	return c
+}
+
+// sweep evicts closed circuits idle for circuitIdleTimeout along with
+// their metric, at most every circuitSweepInterval. cs.mu must be
+// held.
+func (cs *circuits) sweep() {
+	now := time.Now()
+	if now.Sub(cs.lastSweep) < circuitSweepInterval {
+		return
+	}
+	cs.lastSweep = now
+
+	for endpoint, c := range cs.m {
+		if c.state == CircuitClosed && now.Sub(c.lastUsed) > circuitIdleTimeout {
+			delete(cs.m, endpoint)
+			circuitState.DeleteLabelValues(endpoint)
+		}
+	}
+}
+
+// set moves c to state. cs.mu must be held.
+func (cs *circuits) set(endpoint string, c *circuit, state CircuitState) {
+	c.state = state
+
+	value := 0.0
+	switch state {
+	case CircuitOpen:
+		value = 1
+	case CircuitHalfOpen:
+		value = 2
+	}
+	circuitState.WithLabelValues(endpoint).Set(value)
+}
+
+// status returns the circuit breaker of every endpoint called, sorted
+// by endpoint.
+func (cs *circuits) status() []CircuitStatus {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	status := make([]CircuitStatus, 0, len(cs.m))
+	for endpoint, c := range cs.m {
+		s := CircuitStatus{
+			Endpoint:            endpoint,
+			State:               c.state,
+			ConsecutiveFailures: c.consecutive,
+			Requests:            c.requests,
+			Failures:            c.failures,
+		}
+		if c.state != CircuitClosed {
+			openedAt := c.openedAt
+			s.OpenedAt = &openedAt
+		}
+		status = append(status, s)
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Endpoint < status[j].Endpoint
+	})
+
+	return status
+}
+
+// CircuitStatusHandler reports the circuit breaker state of every
+// endpoint called.
+func (a *Api) CircuitStatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":  a.CircuitBreaker.enabled(),
+			"circuits": a.circuits.status(),
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package amp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CertPoolReloader holds a CA bundle loaded from a PEM file and
+// reloads it when the file changes.
+type CertPoolReloader struct {
+	logger *zap.Logger
+	path   string
+
+	mu   sync.RWMutex
+	pem  []byte
+	pool *x509.CertPool
+}
+
+// NewCertPoolReloader loads the CA bundle at path and checks it for
+// changes every interval.
+func NewCertPoolReloader(path string, interval time.Duration, logger *zap.Logger) (*CertPoolReloader, error) {
+	cpr := &CertPoolReloader{
+		logger: logger,
+		path:   path,
+	}
+
+	logger.Info("NewCertPoolReloader loading", zap.String("path", path))
+
+	if _, err := cpr.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			changed, err := cpr.reload()
+			if err != nil {
+				logger.Error("Keeping old CA bundle because the new one could not be loaded",
+					zap.String("path", path),
+					zap.Error(err))
+				continue
+			}
+			if changed {
+				logger.Info("Reloaded CA bundle", zap.String("path", path))
+			}
+		}
+	}()
+
+	return cpr, nil
+}
+
+// reload reads the CA bundle and reports whether it changed.
+func (cpr *CertPoolReloader) reload() (bool, error) {
+	data, err := os.ReadFile(cpr.path)
+	if err != nil {
+		return false, err
+	}
+
+	cpr.mu.RLock()
+	unchanged := bytes.Equal(data, cpr.pem)
+	cpr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	pool, err := certPool(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", cpr.path, err)
+	}
+
+	cpr.mu.Lock()
+	defer cpr.mu.Unlock()
+	cpr.pem, cpr.pool = data, pool
+
+	return true, nil
+}
+
+// Pool returns the current CA bundle. A reload replaces the pool
+// rather than modifying it.
+func (cpr *CertPoolReloader) Pool() *x509.CertPool {
+	cpr.mu.RLock()
+	defer cpr.mu.RUnlock()
+	return cpr.pool
+}
+
+// certPool parses a PEM encoded CA bundle.
+func certPool(data []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM encoded certificates found")
+	}
+
+	return pool, nil
+}
+
+// NewClientTransport returns a transport for endpoint calls that
+// trusts the CA bundle of ca, or the system roots when ca is nil, and
+// presents the key pair of cert when it is not nil. The transport
+// itself is built by newTransport and rebuilt whenever ca is
+// reloaded, cert is read on every handshake.
+func NewClientTransport(ca *CertPoolReloader, cert *KeypairReloader, newTransport func(*tls.Config) http.RoundTripper) http.RoundTripper {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != nil {
+		base.GetClientCertificate = cert.GetClientCertificateFunc()
+	}
+
+	return clientTransport(base, ca, newTransport)
+}
+
+func clientTransport(base *tls.Config, ca *CertPoolReloader, newTransport func(*tls.Config) http.RoundTripper) http.RoundTripper {
+	if ca == nil {
+		return newTransport(base)
+	}
+
+	return &caTransport{base: base, ca: ca, newTransport: newTransport}
+}
+
+// caTransport calls through a transport trusting the current CA
+// bundle of ca. The RootCAs of a transport in use can not be replaced,
+// so a new one is built for every bundle.
+type caTransport struct {
+	base         *tls.Config
+	ca           *CertPoolReloader
+	newTransport func(*tls.Config) http.RoundTripper
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+	rt   http.RoundTripper
+}
+
+func (t *caTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current().RoundTrip(req)
+}
+
+func (t *caTransport) current() http.RoundTripper {
+	pool := t.ca.Pool()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rt == nil || t.pool != pool {
+		cfg := t.base.Clone()
+		cfg.RootCAs = pool
+
+		closeIdleConnections(t.rt)
+		t.rt, t.pool = t.newTransport(cfg), pool
+	}
+
+	return t.rt
+}
+
+// CloseIdleConnections closes the idle connections of the current
+// transport.
+func (t *caTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	closeIdleConnections(t.rt)
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if ci, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// namespaceClient is the HTTP client built from a namespace's client
+// TLS Secret.
+type namespaceClient struct {
+	resourceVersion string
+	client          *http.Client
+}
+
+// namespaceClients caches namespace clients keyed by namespace and
+// Secret name.
+type namespaceClients struct {
+	mu sync.Mutex
+	m  map[string]*namespaceClient
+}
+
+// endpointClient returns the HTTP client for the endpoint calls of
+// namespace, nil when the namespace does not reference a client TLS
+// Secret with ClientTLSSecretAnnotation and HttpClient is used. The
+// Secret may hold a ca.crt to trust and a tls.crt and tls.key to
+// present, ClientCA and ClientCert are used for the ones it lacks.
+func (a *Api) endpointClient(ctx context.Context, namespace string) (*http.Client, error) {
+	secret, err := a.namespaceSecret(ctx, namespace, a.ClientTLSSecretAnnotation)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	key := namespace + "/" + secret.Name
+
+	a.nsClients.mu.Lock()
+	defer a.nsClients.mu.Unlock()
+
+	cached, ok := a.nsClients.m[key]
+	if ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.client, nil
+	}
+
+	client, err := a.secretClient(secret)
+	if err != nil {
+		return nil, fmt.Errorf("client TLS secret %s: %w", key, err)
+	}
+
+	if ok {
+		cached.client.CloseIdleConnections()
+	}
+
+	a.nsClients.m[key] = &namespaceClient{
+		resourceVersion: secret.ResourceVersion,
+		client:          client,
+	}
+
+	return client, nil
+}
+
+// secretClient builds an HTTP client from a client TLS Secret.
+func (a *Api) secretClient(secret *corev1.Secret) (*http.Client, error) {
+	caPEM := secret.Data[corev1.ServiceAccountRootCAKey]
+	certPEM := secret.Data[corev1.TLSCertKey]
+	keyPEM := secret.Data[corev1.TLSPrivateKeyKey]
+
+	if len(caPEM) == 0 && len(certPEM) == 0 {
+		return nil, fmt.Errorf("expected %s or %s and %s", corev1.ServiceAccountRootCAKey, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(certPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		base.Certificates = []tls.Certificate{cert}
+	} else if a.ClientCert != nil {
+		base.GetClientCertificate = a.ClientCert.GetClientCertificateFunc()
+	}
+
+	var rt http.RoundTripper
+	if len(caPEM) > 0 {
+		pool, err := certPool(caPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", corev1.ServiceAccountRootCAKey, err)
+		}
+		base.RootCAs = pool
+		rt = a.NewTransport(base)
+	} else {
+		rt = clientTransport(base, a.ClientCA, a.NewTransport)
+	}
+
+	return &http.Client{
+		Timeout:   a.HttpClient.Timeout,
+		Transport: rt,
+	}, nil
+}
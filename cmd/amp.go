@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -39,6 +41,48 @@ var (
 	certPathKeyEnv            = getEnv("CERT_PATH_KEY", "tls.key")
 	mutationEpAnnotationEnv   = getEnv("MUTATION_EP_ANNOTATION", "mutation.amp.txn2.com/ep")
 	validationEpAnnotationEnv = getEnv("VALIDATION_EP_ANNOTATION", "validation.amp.txn2.com/ep")
+	namespaceResyncEnv        = getEnv("NAMESPACE_RESYNC", "600")
+	podEpOverrideEnv          = getEnv("POD_EP_OVERRIDE", "false")
+	allowedEpHostsAnnotEnv    = getEnv("ALLOWED_EP_HOSTS_ANNOTATION", "amp.txn2.com/allowed-ep-hosts")
+	validationAggEnv          = getEnv("VALIDATION_AGGREGATION", "all")
+	validationAggAnnotEnv     = getEnv("VALIDATION_AGGREGATION_ANNOTATION", "validation.amp.txn2.com/aggregation")
+	patchAllowEnv             = getEnv("PATCH_ALLOW", "")
+	patchDenyEnv              = getEnv("PATCH_DENY", "")
+	patchViolationEnv         = getEnv("PATCH_VIOLATION", "reject")
+	failurePolicyEnv          = getEnv("FAILURE_POLICY", "")
+	failurePolicyAnnotEnv     = getEnv("FAILURE_POLICY_ANNOTATION", "amp.txn2.com/failure-policy")
+	retryMaxEnv               = getEnv("RETRY_MAX", "2")
+	retryBackoffEnv           = getEnv("RETRY_BACKOFF", "100ms")
+	retryMaxBackoffEnv        = getEnv("RETRY_MAX_BACKOFF", "1s")
+	retryStatusCodesEnv       = getEnv("RETRY_STATUS_CODES", "502,503,504")
+	webhookTimeoutEnv         = getEnv("WEBHOOK_TIMEOUT", "10s")
+	endpointTimeoutEnv        = getEnv("ENDPOINT_TIMEOUT", "0s")
+	endpointTimeoutAnnotEnv   = getEnv("ENDPOINT_TIMEOUT_ANNOTATION", "amp.txn2.com/endpoint-timeout")
+	circuitFailuresEnv        = getEnv("CIRCUIT_CONSECUTIVE_FAILURES", "5")
+	circuitFailureRateEnv     = getEnv("CIRCUIT_FAILURE_RATE", "0.5")
+	circuitMinRequestsEnv     = getEnv("CIRCUIT_MIN_REQUESTS", "10")
+	circuitWindowEnv          = getEnv("CIRCUIT_WINDOW", "1m")
+	circuitOpenDurationEnv    = getEnv("CIRCUIT_OPEN_DURATION", "30s")
+	clientCertPathCrtEnv      = getEnv("CLIENT_CERT_PATH_CRT", "")
+	clientCertPathKeyEnv      = getEnv("CLIENT_CERT_PATH_KEY", "")
+	clientCAPathEnv           = getEnv("CLIENT_CA_PATH", "")
+	clientTLSSecretAnnotEnv   = getEnv("CLIENT_TLS_SECRET_ANNOTATION", "amp.txn2.com/client-tls-secret")
+	signingSecretAnnotEnv     = getEnv("SIGNING_SECRET_ANNOTATION", "amp.txn2.com/signing-secret")
+	tokenSourceEnv            = getEnv("TOKEN_SOURCE", "")
+	tokenPathEnv              = getEnv("TOKEN_PATH", "/var/run/secrets/tokens/amp-token")
+	tokenServiceAccountEnv    = getEnv("TOKEN_SERVICE_ACCOUNT", "amp-system/amp-system")
+	tokenExpirationEnv        = getEnv("TOKEN_EXPIRATION", "1h")
+	tokenAudienceEnv          = getEnv("TOKEN_AUDIENCE", "")
+	tokenAudienceAnnotEnv     = getEnv("TOKEN_AUDIENCE_ANNOTATION", "amp.txn2.com/token-audience")
+	tokenAllowedAudiencesEnv  = getEnv("TOKEN_ALLOWED_AUDIENCES", "")
+	egressSchemesEnv          = getEnv("EGRESS_SCHEMES", "")
+	egressAllowedHostsEnv     = getEnv("EGRESS_ALLOWED_HOSTS", "")
+	egressAllowedHostRegexEnv = getEnv("EGRESS_ALLOWED_HOST_REGEXP", "")
+	egressBlockedNetworksEnv  = getEnv("EGRESS_BLOCKED_NETWORKS", amp.DefaultBlockedNetworks)
+	egressBlockAPIServerEnv   = getEnv("EGRESS_BLOCK_API_SERVER", "true")
+	serviceEndpointSlicesEnv  = getEnv("SERVICE_ENDPOINT_SLICES", "false")
+	redactPathsEnv            = getEnv("REDACT_PATHS", "/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration")
+	redactEnvNamesEnv         = getEnv("REDACT_ENV_NAMES", "*PASSWORD*,*SECRET*,*TOKEN*,*KEY*,*CREDENTIAL*")
 )
 
 var Version = "0.0.0"
@@ -53,6 +97,12 @@ func (adt *AddHeaderTransport) RoundTrip(req *http.Request) (*http.Response, err
 	return adt.T.RoundTrip(req)
 }
 
+func (adt *AddHeaderTransport) CloseIdleConnections() {
+	if ci, ok := adt.T.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
 func NewAddHeaderTransport(T http.RoundTripper) *AddHeaderTransport {
 	if T == nil {
 		T = http.DefaultTransport
@@ -73,6 +123,96 @@ func main() {
 		os.Exit(1)
 	}
 
+	namespaceResyncInt, err := strconv.Atoi(namespaceResyncEnv)
+	if err != nil {
+		fmt.Println("Parsing error, NAMESPACE_RESYNC must be an integer in seconds.")
+		os.Exit(1)
+	}
+
+	podEpOverrideBool, err := strconv.ParseBool(podEpOverrideEnv)
+	if err != nil {
+		fmt.Println("Parsing error, POD_EP_OVERRIDE must be true or false.")
+		os.Exit(1)
+	}
+
+	egressBlockAPIServerBool, err := strconv.ParseBool(egressBlockAPIServerEnv)
+	if err != nil {
+		fmt.Println("Parsing error, EGRESS_BLOCK_API_SERVER must be true or false.")
+		os.Exit(1)
+	}
+
+	serviceEndpointSlicesBool, err := strconv.ParseBool(serviceEndpointSlicesEnv)
+	if err != nil {
+		fmt.Println("Parsing error, SERVICE_ENDPOINT_SLICES must be true or false.")
+		os.Exit(1)
+	}
+
+	retryMaxInt, err := strconv.Atoi(retryMaxEnv)
+	if err != nil {
+		fmt.Println("Parsing error, RETRY_MAX must be an integer.")
+		os.Exit(1)
+	}
+
+	retryBackoffDuration, err := time.ParseDuration(retryBackoffEnv)
+	if err != nil {
+		fmt.Println("Parsing error, RETRY_BACKOFF must be a duration, e.g. 100ms.")
+		os.Exit(1)
+	}
+
+	retryMaxBackoffDuration, err := time.ParseDuration(retryMaxBackoffEnv)
+	if err != nil {
+		fmt.Println("Parsing error, RETRY_MAX_BACKOFF must be a duration, e.g. 1s.")
+		os.Exit(1)
+	}
+
+	webhookTimeoutDuration, err := time.ParseDuration(webhookTimeoutEnv)
+	if err != nil {
+		fmt.Println("Parsing error, WEBHOOK_TIMEOUT must be a duration, e.g. 10s.")
+		os.Exit(1)
+	}
+
+	endpointTimeoutDuration, err := time.ParseDuration(endpointTimeoutEnv)
+	if err != nil {
+		fmt.Println("Parsing error, ENDPOINT_TIMEOUT must be a duration, e.g. 2s.")
+		os.Exit(1)
+	}
+
+	circuitFailuresInt, err := strconv.Atoi(circuitFailuresEnv)
+	if err != nil {
+		fmt.Println("Parsing error, CIRCUIT_CONSECUTIVE_FAILURES must be an integer.")
+		os.Exit(1)
+	}
+
+	circuitFailureRateFloat, err := strconv.ParseFloat(circuitFailureRateEnv, 64)
+	if err != nil {
+		fmt.Println("Parsing error, CIRCUIT_FAILURE_RATE must be a number between 0 and 1.")
+		os.Exit(1)
+	}
+
+	circuitMinRequestsInt, err := strconv.Atoi(circuitMinRequestsEnv)
+	if err != nil {
+		fmt.Println("Parsing error, CIRCUIT_MIN_REQUESTS must be an integer.")
+		os.Exit(1)
+	}
+
+	circuitWindowDuration, err := time.ParseDuration(circuitWindowEnv)
+	if err != nil {
+		fmt.Println("Parsing error, CIRCUIT_WINDOW must be a duration, e.g. 1m.")
+		os.Exit(1)
+	}
+
+	circuitOpenDurationDuration, err := time.ParseDuration(circuitOpenDurationEnv)
+	if err != nil {
+		fmt.Println("Parsing error, CIRCUIT_OPEN_DURATION must be a duration, e.g. 30s.")
+		os.Exit(1)
+	}
+
+	tokenExpirationDuration, err := time.ParseDuration(tokenExpirationEnv)
+	if err != nil {
+		fmt.Println("Parsing error, TOKEN_EXPIRATION must be a duration, e.g. 1h.")
+		os.Exit(1)
+	}
+
 	var (
 		ip                     = flag.String("ip", ipEnv, "Server IP address to bind to.")
 		port                   = flag.String("port", portEnv, "Server port.")
@@ -84,9 +224,95 @@ func main() {
 		httpWriteTimeout       = flag.Int("httpWriteTimeout", httpWriteTimeoutInt, "HTTP write timeout")
 		mutationEpAnnotation   = flag.String("mutationEpAnnotation", mutationEpAnnotationEnv, "Mutation endpoint annotation")
 		validationEpAnnotation = flag.String("validationEpAnnotation", validationEpAnnotationEnv, "Validation endpoint annotation")
+		namespaceResync        = flag.Int("namespaceResync", namespaceResyncInt, "Namespace cache resync period in seconds")
+		podEpOverride          = flag.Bool("podEpOverride", podEpOverrideBool, "Allow Pod annotations to override the Namespace endpoint")
+		allowedEpHostsAnnot    = flag.String("allowedEpHostsAnnotation", allowedEpHostsAnnotEnv, "Namespace annotation listing hosts Pod endpoint overrides may use")
+		validationAgg          = flag.String("validationAggregation", validationAggEnv, "Default validation aggregation: all, any or a quorum count")
+		validationAggAnnot     = flag.String("validationAggregationAnnotation", validationAggAnnotEnv, "Namespace annotation overriding the validation aggregation")
+		patchAllow             = flag.String("patchAllow", patchAllowEnv, "Comma separated JSON Pointer prefixes mutation patches may modify, empty allows all")
+		patchDeny              = flag.String("patchDeny", patchDenyEnv, "Comma separated JSON Pointer prefixes mutation patches may not modify")
+		patchViolation         = flag.String("patchViolation", patchViolationEnv, "Action on patch policy violations: reject or strip")
+		failurePolicyFlag      = flag.String("failurePolicy", failurePolicyEnv, "Default failure policy, Fail or Ignore optionally per class, e.g. Fail,transport=Ignore. Classes without a policy fail validation and ignore mutation failures")
+		failurePolicyAnnot     = flag.String("failurePolicyAnnotation", failurePolicyAnnotEnv, "Namespace annotation overriding the failure policy")
+		retryMax               = flag.Int("retryMax", retryMaxInt, "Retries of failed endpoint calls, 0 disables retries")
+		retryBackoff           = flag.Duration("retryBackoff", retryBackoffDuration, "Delay before the first retry, doubled for every further retry")
+		retryMaxBackoff        = flag.Duration("retryMaxBackoff", retryMaxBackoffDuration, "Maximum delay between retries")
+		retryStatusCodes       = flag.String("retryStatusCodes", retryStatusCodesEnv, "Comma separated endpoint response codes that are retried")
+		webhookTimeout         = flag.Duration("webhookTimeout", webhookTimeoutDuration, "Webhook timeoutSeconds, used when the API server does not send a timeout")
+		endpointTimeout        = flag.Duration("endpointTimeout", endpointTimeoutDuration, "Timeout of each endpoint call attempt, 0 uses the remaining webhook timeout")
+		endpointTimeoutAnnot   = flag.String("endpointTimeoutAnnotation", endpointTimeoutAnnotEnv, "Namespace annotation overriding the endpoint timeout")
+		circuitFailures        = flag.Int("circuitConsecutiveFailures", circuitFailuresInt, "Consecutive endpoint failures opening its circuit, 0 disables")
+		circuitFailureRate     = flag.Float64("circuitFailureRate", circuitFailureRateFloat, "Endpoint failure rate within circuitWindow opening its circuit, 0 disables")
+		circuitMinRequests     = flag.Int("circuitMinRequests", circuitMinRequestsInt, "Endpoint calls within circuitWindow before circuitFailureRate applies")
+		circuitWindow          = flag.Duration("circuitWindow", circuitWindowDuration, "Window the endpoint failure rate is measured over")
+		circuitOpenDuration    = flag.Duration("circuitOpenDuration", circuitOpenDurationDuration, "Time an open circuit fails calls before probing the endpoint")
+		clientCertPathCrt      = flag.String("clientCertPathCrt", clientCertPathCrtEnv, "Client cert path tls.crt presented to endpoints. Requires clientCertPathKey.")
+		clientCertPathKey      = flag.String("clientCertPathKey", clientCertPathKeyEnv, "Client cert path tls.key presented to endpoints. Requires clientCertPathCrt.")
+		clientCAPath           = flag.String("clientCAPath", clientCAPathEnv, "CA bundle path trusted for endpoint calls, empty uses the system roots")
+		clientTLSSecretAnnot   = flag.String("clientTLSSecretAnnotation", clientTLSSecretAnnotEnv, "Namespace annotation referencing a Secret with the client TLS of its endpoint calls")
+		signingSecretAnnot     = flag.String("signingSecretAnnotation", signingSecretAnnotEnv, "Namespace annotation referencing a Secret with the key signing its endpoint calls")
+		tokenSource            = flag.String("tokenSource", tokenSourceEnv, "Bearer token source for endpoint calls: file, tokenrequest or empty for none")
+		tokenPath              = flag.String("tokenPath", tokenPathEnv, "Projected ServiceAccount token path for the file token source")
+		tokenServiceAccount    = flag.String("tokenServiceAccount", tokenServiceAccountEnv, "namespace/name of the ServiceAccount tokens are requested for by the tokenrequest token source")
+		tokenExpiration        = flag.Duration("tokenExpiration", tokenExpirationDuration, "Lifetime of tokens requested by the tokenrequest token source")
+		tokenAudience          = flag.String("tokenAudience", tokenAudienceEnv, "Default bearer token audience, empty sends tokens only to namespaces choosing an audience")
+		tokenAudienceAnnot     = flag.String("tokenAudienceAnnotation", tokenAudienceAnnotEnv, "Namespace annotation choosing the bearer token audience")
+		egressSchemes          = flag.String("egressSchemes", egressSchemesEnv, "Comma separated URL schemes endpoints may use, any when empty")
+		egressAllowedHosts     = flag.String("egressAllowedHosts", egressAllowedHostsEnv, "Comma separated glob patterns of hosts endpoints may use")
+		egressAllowedHostRegex = flag.String("egressAllowedHostRegexp", egressAllowedHostRegexEnv, "Regular expression matching the whole host endpoints may use")
+		egressBlockedNetworks  = flag.String("egressBlockedNetworks", egressBlockedNetworksEnv, "Comma separated CIDRs and addresses endpoint calls may not connect to")
+		egressBlockAPIServer   = flag.Bool("egressBlockAPIServer", egressBlockAPIServerBool, "Block endpoint calls to the addresses of the Kubernetes API server")
+		serviceEndpointSlices  = flag.Bool("serviceEndpointSlices", serviceEndpointSlicesBool, "Call Service endpoints at their ready EndpointSlice addresses instead of the Service address")
+		redactPaths            = flag.String("redactPaths", redactPathsEnv, "Comma separated JSON Pointers of object fields redacted in logs and minimal payloads, * matches any key or index")
+		redactEnvNames         = flag.String("redactEnvNames", redactEnvNamesEnv, "Comma separated glob patterns of container env var names whose values are redacted in logs and minimal payloads")
+		tokenAllowedAudiences  = flag.String("tokenAllowedAudiences", tokenAllowedAudiencesEnv, "Comma separated glob patterns of audiences namespaces may choose, {namespace} is replaced with the namespace")
 	)
 	flag.Parse()
 
+	aggregation, err := amp.ParseAggregation(*validationAgg)
+	if err != nil {
+		fmt.Printf("Parsing error, %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	patchViolationAction, err := amp.ParsePolicyAction(*patchViolation)
+	if err != nil {
+		fmt.Printf("Parsing error, %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	failurePolicy, err := amp.ParseFailurePolicy(*failurePolicyFlag, amp.FailurePolicy{})
+	if err != nil {
+		fmt.Printf("Parsing error, %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	retryCodes, err := amp.ParseStatusCodes(*retryStatusCodes)
+	if err != nil {
+		fmt.Printf("Parsing error, %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	egress := amp.EgressPolicy{
+		Schemes:      splitList(*egressSchemes),
+		AllowedHosts: splitList(*egressAllowedHosts),
+	}
+
+	if *egressAllowedHostRegex != "" {
+		re, err := amp.ParseHostPattern(*egressAllowedHostRegex)
+		if err != nil {
+			fmt.Printf("Parsing error, EGRESS_ALLOWED_HOST_REGEXP: %s\n", err.Error())
+			os.Exit(1)
+		}
+		egress.AllowedHostPatterns = []*regexp.Regexp{re}
+	}
+
+	egress.BlockedNetworks, err = amp.ParseNetworks(*egressBlockedNetworks)
+	if err != nil {
+		fmt.Printf("Parsing error, EGRESS_BLOCKED_NETWORKS: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	// add some useful info to metrics
 	promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: Service + "_service",
@@ -139,20 +365,6 @@ func main() {
 	}
 	p.Use(r)
 
-	// Create HTTP Client required by API
-	netTransport := &http.Transport{
-		MaxIdleConnsPerHost: 10,
-		DialContext: (&net.Dialer{
-			Timeout: 10 * time.Second,
-		}).DialContext,
-		TLSHandshakeTimeout: 10 * time.Second,
-	}
-
-	httpClient := &http.Client{
-		Timeout:   time.Second * 10,
-		Transport: NewAddHeaderTransport(netTransport),
-	}
-
 	// Create Kubernetes Client Set required by API
 	// Kubernetes
 	kubeconfig := filepath.Join(
@@ -172,13 +384,123 @@ func main() {
 		logger.Fatal("unable to kubernetes.NewForConfig", zap.Error(err))
 	}
 
+	// Bearer tokens for endpoint calls
+	var tokens amp.TokenSource
+	switch *tokenSource {
+	case "":
+	case "file":
+		tokens = amp.NewFileTokenSource(*tokenPath, *tokenAudience)
+	case "tokenrequest":
+		sa := strings.SplitN(*tokenServiceAccount, "/", 2)
+		if len(sa) != 2 {
+			logger.Fatal("tokenServiceAccount must be namespace/name",
+				zap.Stringp("tokenServiceAccount", tokenServiceAccount))
+		}
+		tokens = amp.NewTokenRequestSource(cs, sa[0], sa[1], *tokenExpiration)
+	default:
+		logger.Fatal("tokenSource must be file, tokenrequest or empty",
+			zap.Stringp("tokenSource", tokenSource))
+	}
+
+	if *egressBlockAPIServer {
+		egress.BlockedNetworks = append(egress.BlockedNetworks, apiServerNetworks(config, logger)...)
+	}
+
+	// Create HTTP Client required by API
+	newTransport := func(tlsConfig *tls.Config) http.RoundTripper {
+		var t http.RoundTripper = &http.Transport{
+			MaxIdleConnsPerHost: 10,
+			DialContext: amp.ServiceDialContext(egress.Dialer(&net.Dialer{
+				Timeout: 10 * time.Second,
+			}).DialContext),
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		}
+
+		if tokens != nil {
+			t = amp.NewTokenTransport(t, tokens)
+		}
+
+		return NewAddHeaderTransport(t)
+	}
+
+	var clientCert *amp.KeypairReloader
+	if *clientCertPathCrt != "" && *clientCertPathKey != "" {
+		clientCert, err = amp.NewKeypairReloader(*clientCertPathCrt, *clientCertPathKey, logger)
+		if err != nil {
+			logger.Fatal("NewKeypairReloader failed to load client cert",
+				zap.Stringp("clientCertPathKey", clientCertPathKey),
+				zap.Stringp("clientCertPathCrt", clientCertPathCrt),
+				zap.Error(err),
+			)
+		}
+	}
+
+	var clientCA *amp.CertPoolReloader
+	if *clientCAPath != "" {
+		clientCA, err = amp.NewCertPoolReloader(*clientCAPath, time.Minute, logger)
+		if err != nil {
+			logger.Fatal("NewCertPoolReloader failed to load CA bundle",
+				zap.Stringp("clientCAPath", clientCAPath),
+				zap.Error(err),
+			)
+		}
+	}
+
+	httpClient := &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: amp.NewClientTransport(clientCA, clientCert, newTransport),
+	}
+
 	// get api
 	api, err := amp.NewApi(&amp.Config{
-		Log:                    logger,
-		HttpClient:             httpClient,
-		Cs:                     cs,
-		MutationEpAnnotation:   *mutationEpAnnotation,
-		ValidationEpAnnotation: *validationEpAnnotation,
+		Log:                             logger,
+		HttpClient:                      httpClient,
+		Cs:                              cs,
+		MutationEpAnnotation:            *mutationEpAnnotation,
+		ValidationEpAnnotation:          *validationEpAnnotation,
+		NamespaceResync:                 time.Duration(*namespaceResync) * time.Second,
+		PodEpOverride:                   *podEpOverride,
+		AllowedEpHostsAnnotation:        *allowedEpHostsAnnot,
+		ValidationAggregation:           aggregation,
+		ValidationAggregationAnnotation: *validationAggAnnot,
+		PatchPolicy: amp.PatchPolicy{
+			Allowed:   amp.ParsePrefixes(*patchAllow),
+			Forbidden: amp.ParsePrefixes(*patchDeny),
+			Action:    patchViolationAction,
+		},
+		FailurePolicy:           failurePolicy,
+		FailurePolicyAnnotation: *failurePolicyAnnot,
+		Retry: amp.RetryPolicy{
+			Max:         *retryMax,
+			Backoff:     *retryBackoff,
+			MaxBackoff:  *retryMaxBackoff,
+			StatusCodes: retryCodes,
+		},
+		WebhookTimeout:            *webhookTimeout,
+		EndpointTimeout:           *endpointTimeout,
+		EndpointTimeoutAnnotation: *endpointTimeoutAnnot,
+		CircuitBreaker: amp.CircuitPolicy{
+			ConsecutiveFailures: *circuitFailures,
+			FailureRate:         *circuitFailureRate,
+			MinRequests:         *circuitMinRequests,
+			Window:              *circuitWindow,
+			OpenDuration:        *circuitOpenDuration,
+		},
+		ClientCA:                  clientCA,
+		ClientCert:                clientCert,
+		ClientTLSSecretAnnotation: *clientTLSSecretAnnot,
+		NewTransport:              newTransport,
+		SigningSecretAnnotation:   *signingSecretAnnot,
+		TokenAudience:             *tokenAudience,
+		TokenAudienceAnnotation:   *tokenAudienceAnnot,
+		AllowedTokenAudiences:     splitList(*tokenAllowedAudiences),
+		Egress:                    egress,
+		ServiceEndpointSlices:     *serviceEndpointSlices,
+		Redaction: amp.RedactionPolicy{
+			Paths:    splitList(*redactPaths),
+			EnvNames: splitList(*redactEnvNames),
+		},
 	})
 	if err != nil {
 		logger.Fatal("Error getting API.", zap.Error(err))
@@ -187,6 +509,9 @@ func main() {
 	// status
 	r.GET("/", api.OkHandler(Version, *mode, Service))
 
+	// endpoint circuit breakers
+	r.GET("/circuits", api.CircuitStatusHandler())
+
 	// validate proxy
 	r.POST("/validate", api.AdmissionReviewHandler(amp.AdmissionReviewValidate))
 
@@ -249,6 +574,50 @@ func main() {
 
 }
 
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// apiServerNetworks returns the addresses of the Kubernetes API server
+// as seen through the in-cluster service and config.
+func apiServerNetworks(config *rest.Config, logger *zap.Logger) []*net.IPNet {
+	hosts := []string{os.Getenv("KUBERNETES_SERVICE_HOST")}
+	if u, err := url.Parse(config.Host); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+
+	var networks []*net.IPNet
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			logger.Warn("unable to resolve API server address for the egress policy",
+				zap.String("host", host), zap.Error(err))
+			continue
+		}
+
+		for _, ip := range ips {
+			n, err := amp.ParseNetworks(ip.String())
+			if err == nil {
+				networks = append(networks, n...)
+			}
+		}
+	}
+
+	return networks
+}
+
 // getEnv gets an environment variable or sets a default if
 // one does not exist.
 func getEnv(key, fallback string) string {
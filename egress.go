@@ -0,0 +1,251 @@
+package amp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Egress rejection reasons, used in logs and the egress rejection
+// metric.
+const (
+	EgressReasonScheme  = "scheme"
+	EgressReasonHost    = "host"
+	EgressReasonAddress = "address"
+)
+
+// DefaultBlockedNetworks are the loopback, link-local (including the
+// cloud metadata service at 169.254.169.254) and unspecified address
+// ranges, see ParseNetworks.
+const DefaultBlockedNetworks = "127.0.0.0/8,::1/128,169.254.0.0/16,fe80::/10,0.0.0.0/8,::/128"
+
+// EgressError is the error of an endpoint call the EgressPolicy does
+// not permit.
+type EgressError struct {
+	Reason string
+	Err    error
+}
+
+func (e *EgressError) Error() string {
+	return "denied by egress policy: " + e.Err.Error()
+}
+
+func (e *EgressError) Unwrap() error {
+	return e.Err
+}
+
+// EgressPolicy restricts where endpoint calls may go, whatever a
+// namespace annotates. Schemes and hosts are checked before a call is
+// made and on every redirect. Addresses are checked when connecting,
+// so a host resolving to a blocked address is rejected as well, which
+// requires the endpoint transports to dial with Dialer. The zero value
+// permits every endpoint.
+type EgressPolicy struct {
+	// Schemes are the URL schemes endpoints may use, any when empty.
+	Schemes []string
+
+	// AllowedHosts are glob patterns (see path.Match) and
+	// AllowedHostPatterns regular expressions matching the hosts
+	// endpoints may use. A regular expression must match the whole
+	// host, see ParseHostPattern. When both are empty any host is
+	// allowed.
+	AllowedHosts        []string
+	AllowedHostPatterns []*regexp.Regexp
+
+	// BlockedNetworks are the addresses endpoint calls may not connect
+	// to, such as the cloud metadata service and the API server.
+	BlockedNetworks []*net.IPNet
+}
+
+// ParseHostPattern compiles a regular expression for
+// AllowedHostPatterns anchored to match the whole host, so
+// svc\.cluster\.local does not match svc.cluster.local.example.com.
+func ParseHostPattern(value string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + value + ")$")
+}
+
+// ParseNetworks parses a comma separated list of CIDRs and addresses.
+func ParseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, n := range strings.Split(value, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", n)
+			}
+			networks = append(networks, hostNetwork(ip))
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", n)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// hostNetwork returns the network holding only ip.
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// checkURL returns an *EgressError when the policy does not permit
+// calls to u.
+func (egp EgressPolicy) checkURL(u *url.URL) error {
+	if !egp.schemeAllowed(u.Scheme) {
+		return &EgressError{Reason: EgressReasonScheme, Err: fmt.Errorf("scheme %q is not allowed", u.Scheme)}
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if !egp.hostAllowed(host) {
+		return &EgressError{Reason: EgressReasonHost, Err: fmt.Errorf("host %s is not allowed", host)}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return egp.checkIP(ip)
+	}
+
+	return nil
+}
+
+func (egp EgressPolicy) schemeAllowed(scheme string) bool {
+	if len(egp.Schemes) == 0 {
+		return true
+	}
+
+	for _, s := range egp.Schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (egp EgressPolicy) hostAllowed(host string) bool {
+	if len(egp.AllowedHosts) == 0 && len(egp.AllowedHostPatterns) == 0 {
+		return true
+	}
+
+	if host == "" {
+		return false
+	}
+
+	for _, p := range egp.AllowedHosts {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+
+	for _, re := range egp.AllowedHostPatterns {
+		if loc := re.FindStringIndex(host); loc != nil && loc[0] == 0 && loc[1] == len(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkIP returns an *EgressError when ip is in a blocked network.
+func (egp EgressPolicy) checkIP(ip net.IP) error {
+	for _, network := range egp.BlockedNetworks {
+		if network.Contains(ip) {
+			return &EgressError{Reason: EgressReasonAddress, Err: fmt.Errorf("address %s is in blocked network %s", ip, network)}
+		}
+	}
+
+	return nil
+}
+
+// Dialer returns a copy of d refusing to connect to BlockedNetworks.
+// The resolved address of every connection is checked, use it to dial
+// endpoint transports:
+//
+//	DialContext: policy.Dialer(&net.Dialer{Timeout: 10 * time.Second}).DialContext
+//
+// Connections through a proxy are checked against the address of the
+// proxy.
+func (egp EgressPolicy) Dialer(d *net.Dialer) *net.Dialer {
+	dialer := *d
+	if len(egp.BlockedNetworks) == 0 {
+		return &dialer
+	}
+
+	control := d.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			if err := egp.checkIP(ip); err != nil {
+				return err
+			}
+		}
+
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+
+	return &dialer
+}
+
+// client returns client, or a copy checking redirects against the
+// policy when schemes or hosts are restricted.
+func (egp EgressPolicy) client(client *http.Client) *http.Client {
+	if len(egp.Schemes) == 0 && len(egp.AllowedHosts) == 0 && len(egp.AllowedHostPatterns) == 0 {
+		return client
+	}
+
+	c := *client
+	checkRedirect := client.CheckRedirect
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := egp.checkURL(req.URL); err != nil {
+			return err
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+
+	return &c
+}
+
+// defaultNewTransport clones http.DefaultTransport with tlsConfig,
+// dialing Service endpoints with the Egress policy.
+func (a *Api) defaultNewTransport(tlsConfig *tls.Config) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.DialContext = ServiceDialContext(a.Egress.Dialer(&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext)
+	return t
+}
@@ -0,0 +1,234 @@
+package amp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func mustNetworks(t *testing.T, value string) []*net.IPNet {
+	t.Helper()
+
+	networks, err := ParseNetworks(value)
+	if err != nil {
+		t.Fatalf("ParseNetworks(%q) error = %v", value, err)
+	}
+
+	return networks
+}
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "10.0.0.0/8, 192.168.1.1", want: []string{"10.0.0.0/8", "192.168.1.1/32"}},
+		{value: "fd00::/8,::1", want: []string{"fd00::/8", "::1/128"}},
+		{value: DefaultBlockedNetworks, want: []string{"127.0.0.0/8", "::1/128", "169.254.0.0/16", "fe80::/10", "0.0.0.0/8", "::/128"}},
+		{value: "10.0.0.0/33", wantErr: true},
+		{value: "example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		networks, err := ParseNetworks(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseNetworks(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+
+		var got []string
+		for _, n := range networks {
+			got = append(got, n.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseNetworks(%q) = %v, want %v", tt.value, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseNetworks(%q) = %v, want %v", tt.value, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestEgressPolicyCheckURL(t *testing.T) {
+	policy := EgressPolicy{
+		Schemes:             []string{"https"},
+		AllowedHosts:        []string{"*.svc", "hooks.example.com"},
+		AllowedHostPatterns: []*regexp.Regexp{regexp.MustCompile(`^[a-z]+\.team-[a-z]+\.example\.org$`), regexp.MustCompile(`svc\.cluster\.local`)},
+		BlockedNetworks:     mustNetworks(t, DefaultBlockedNetworks+",10.96.0.1"),
+	}
+
+	tests := []struct {
+		url    string
+		reason string
+	}{
+		{url: "https://hooks.example.com/mutate"},
+		{url: "HTTPS://HOOKS.EXAMPLE.COM./mutate"},
+		{url: "https://hooks.team-a.svc:8443/validate"},
+		{url: "https://policy.team-a.example.org/validate"},
+		{url: "http://hooks.example.com/mutate", reason: EgressReasonScheme},
+		{url: "file:///etc/passwd", reason: EgressReasonScheme},
+		{url: "https://evil.example.com/mutate", reason: EgressReasonHost},
+		{url: "https://hooks.example.com.evil.com/mutate", reason: EgressReasonHost},
+		{url: "https://policy.team-a.example.org.evil.com/validate", reason: EgressReasonHost},
+		{url: "https://svc.cluster.local/mutate"},
+		{url: "https://svc.cluster.local.attacker.com/mutate", reason: EgressReasonHost},
+		{url: "https://attacker.svc.cluster.local/mutate", reason: EgressReasonHost},
+		{url: "https:///mutate", reason: EgressReasonHost},
+		{url: "https://169.254.169.254/latest/meta-data", reason: EgressReasonHost},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = policy.checkURL(u)
+		assertEgressReason(t, tt.url, err, tt.reason)
+	}
+}
+
+func TestParseHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: `svc\.cluster\.local`, host: "svc.cluster.local", want: true},
+		{pattern: `svc\.cluster\.local`, host: "svc.cluster.local.attacker.com"},
+		{pattern: `svc\.cluster\.local`, host: "attacker-svc.cluster.local"},
+		{pattern: `[a-z.-]+\.svc|hooks\.example\.com`, host: "hooks.team-a.svc", want: true},
+		{pattern: `[a-z.-]+\.svc|hooks\.example\.com`, host: "hooks.example.com.attacker.com"},
+		{pattern: `^hooks\.example\.com$`, host: "hooks.example.com", want: true},
+	}
+
+	for _, tt := range tests {
+		re, err := ParseHostPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("ParseHostPattern(%q) error = %v", tt.pattern, err)
+		}
+
+		policy := EgressPolicy{AllowedHostPatterns: []*regexp.Regexp{re}}
+		if got := policy.hostAllowed(tt.host); got != tt.want {
+			t.Errorf("ParseHostPattern(%q) allows %s = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+
+	if _, err := ParseHostPattern("("); err == nil {
+		t.Error("ParseHostPattern(\"(\") expected an error")
+	}
+}
+
+func TestEgressPolicyCheckURLAddresses(t *testing.T) {
+	policy := EgressPolicy{BlockedNetworks: mustNetworks(t, DefaultBlockedNetworks+",10.96.0.1")}
+
+	tests := []struct {
+		url    string
+		reason string
+	}{
+		{url: "http://hooks.example.com/mutate"},
+		{url: "http://10.0.0.1/mutate"},
+		{url: "http://169.254.169.254/latest/meta-data", reason: EgressReasonAddress},
+		{url: "http://127.0.0.1:8080/mutate", reason: EgressReasonAddress},
+		{url: "http://[::1]:8080/mutate", reason: EgressReasonAddress},
+		{url: "http://[::ffff:127.0.0.1]/mutate", reason: EgressReasonAddress},
+		{url: "http://10.96.0.1/api", reason: EgressReasonAddress},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEgressReason(t, tt.url, policy.checkURL(u), tt.reason)
+	}
+}
+
+// assertEgressReason asserts that err is an *EgressError with reason,
+// or nil when reason is empty.
+func assertEgressReason(t *testing.T, target string, err error, reason string) {
+	t.Helper()
+
+	if reason == "" {
+		if err != nil {
+			t.Errorf("%s denied: %v", target, err)
+		}
+		return
+	}
+
+	var egressErr *EgressError
+	if !errors.As(err, &egressErr) {
+		t.Errorf("%s error = %v, want an EgressError for %s", target, err, reason)
+		return
+	}
+	if egressErr.Reason != reason {
+		t.Errorf("%s denied for %s, want %s", target, egressErr.Reason, reason)
+	}
+}
+
+func TestEgressPolicyZeroValue(t *testing.T) {
+	var policy EgressPolicy
+
+	for _, target := range []string{"http://127.0.0.1/", "file:///etc/passwd", "https://anything.example.com/"} {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.checkURL(u); err != nil {
+			t.Errorf("zero EgressPolicy denied %s: %v", target, err)
+		}
+	}
+}
+
+func TestEgressPolicyDialer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := EgressPolicy{BlockedNetworks: mustNetworks(t, DefaultBlockedNetworks)}
+	open := EgressPolicy{BlockedNetworks: mustNetworks(t, "10.0.0.0/8")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a host name resolving to a blocked address is only caught when
+	// connecting
+	_, err = blocked.Dialer(&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort("localhost", port))
+	assertEgressReason(t, "localhost", err, EgressReasonAddress)
+
+	conn, err := open.Dialer(&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("dial with 127.0.0.0/8 allowed error = %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestEgressPolicyRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	policy := EgressPolicy{AllowedHosts: []string{"127.0.0.1"}}
+	client := policy.client(&http.Client{Timeout: 5 * time.Second})
+
+	_, err := client.Get(srv.URL)
+	assertEgressReason(t, "redirect", err, EgressReasonHost)
+}
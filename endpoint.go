@@ -0,0 +1,333 @@
+package amp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// ParseEndpoints parses an ordered list of endpoints separated by
+// commas or whitespace, as found in an endpoint annotation. Each
+// endpoint is a URL, or a Service reference (see
+// ParseServiceReference), optionally followed by semicolon separated
+// options:
+//
+//	https://hooks.example.com/mutate;format=envelope
+//	service/hooks/mutator:8443/mutate;timeout=2s
+//
+// Supported options are format (legacy, envelope or admissionreview),
+// payload (full or minimal), response (jsonpatch, mergepatch or
+// object) and timeout (a duration such as 2s).
+func ParseEndpoints(value string) ([]Endpoint, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	eps := make([]Endpoint, 0, len(fields))
+	for _, f := range fields {
+		ep, err := parseEndpoint(f)
+		if err != nil {
+			return nil, err
+		}
+		eps = append(eps, ep)
+	}
+
+	return eps, nil
+}
+
+func parseEndpoint(value string) (Endpoint, error) {
+	parts := strings.Split(value, ";")
+	ep := Endpoint{URL: parts[0]}
+
+	if strings.HasPrefix(parts[0], servicePrefix) {
+		ref, err := ParseServiceReference(parts[0])
+		if err != nil {
+			return Endpoint{}, err
+		}
+		ep.URL, ep.Service = ref.URL(), ref
+	}
+
+	for _, opt := range parts[1:] {
+		if opt == "" {
+			continue
+		}
+
+		k, v := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			k, v = opt[:i], opt[i+1:]
+		}
+
+		switch k {
+		case "format":
+			format, err := ParsePayloadFormat(v)
+			if err != nil {
+				return Endpoint{}, fmt.Errorf("endpoint %s: %w", ep.URL, err)
+			}
+			ep.Format = format
+		case "payload":
+			payload, err := ParsePayloadProjection(v)
+			if err != nil {
+				return Endpoint{}, fmt.Errorf("endpoint %s: %w", ep.URL, err)
+			}
+			ep.Payload = payload
+		case "response":
+			response, err := ParseResponseFormat(v)
+			if err != nil {
+				return Endpoint{}, fmt.Errorf("endpoint %s: %w", ep.URL, err)
+			}
+			ep.Response = response
+		case "timeout":
+			timeout, err := time.ParseDuration(v)
+			if err != nil || timeout <= 0 {
+				return Endpoint{}, fmt.Errorf("endpoint %s: invalid timeout %q", ep.URL, v)
+			}
+			ep.Timeout = timeout
+		default:
+			return Endpoint{}, fmt.Errorf("endpoint %s: unknown option %q", ep.URL, k)
+		}
+	}
+
+	return ep, nil
+}
+
+// prepareEndpoints sets the timeout, client, signer and token audience
+// of the endpoints resolved for req, and the addresses of Service
+// endpoints when ServiceEndpointSlices is set. Endpoints keep a
+// timeout of their own.
+func (a *Api) prepareEndpoints(ctx context.Context, req *admissionv1.AdmissionRequest, eps []Endpoint, logInfo []zap.Field) error {
+	timeout := a.endpointTimeout(ctx, req.Namespace, logInfo)
+
+	client, err := a.endpointClient(ctx, req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	s, err := a.endpointSigner(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	audience, err := a.tokenAudience(ctx, req.Namespace, logInfo)
+	if err != nil {
+		return err
+	}
+
+	for i := range eps {
+		if eps[i].Timeout == 0 {
+			eps[i].Timeout = timeout
+		}
+		eps[i].client = client
+		eps[i].signer = s
+		eps[i].audience = audience
+
+		if eps[i].Service != nil && a.ServiceEndpointSlices {
+			addrs, err := a.serviceAddresses(eps[i].Service)
+			if err != nil {
+				return err
+			}
+			eps[i].addrs = addrs
+		}
+	}
+
+	return nil
+}
+
+// callEndpoint POSTs body to ep and returns the response body and
+// Content-Type of a 200 response, retrying failed attempts according
+// to a.Retry until ctx is done. Calls to an endpoint with an open
+// circuit, or made after ctx is done, fail without being made. Errors
+// are an *EndpointError.
+func (a *Api) callEndpoint(ctx context.Context, ep Endpoint, body []byte, logInfo []zap.Field) ([]byte, string, error) {
+	if err := ctx.Err(); err != nil {
+		a.Log.Warn("admission request abandoned, skipping endpoint request",
+			append(logInfo, zap.Error(err))...,
+		)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureTransport, Err: fmt.Errorf("admission request abandoned: %w", err)}
+	}
+
+	if err := a.checkEgress(ep, logInfo); err != nil {
+		return nil, "", err
+	}
+
+	server := circuitKey(ep.URL)
+	if !a.circuits.allow(server) {
+		a.Log.Warn("endpoint circuit open, skipping request", logInfo...)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureTransport, Err: errCircuitOpen}
+	}
+
+	respBody, contentType, err := a.callEndpointRetry(ctx, ep, body, logInfo)
+
+	if ctx.Err() != nil {
+		// a request the API server gave up on says nothing about the
+		// endpoint's health
+		if !errors.Is(context.Cause(ctx), errWebhookDeadline) {
+			a.Log.Warn("admission request cancelled by the API server, endpoint request abandoned",
+				append(logInfo, zap.Error(context.Cause(ctx)))...,
+			)
+			a.circuits.release(server)
+			return respBody, contentType, err
+		}
+
+		a.Log.Warn("webhook deadline exceeded, endpoint request abandoned", logInfo...)
+	}
+
+	switch class := failureClass(err); {
+	case err == nil:
+		a.circuits.record(server, false)
+	case class == FailureTransport || class == FailureStatus:
+		a.circuits.record(server, true)
+	default:
+		// egress, signing and token failures never reached the
+		// endpoint, they say nothing about its health
+		a.circuits.release(server)
+	}
+
+	return respBody, contentType, err
+}
+
+// callEndpointRetry calls ep, retrying failed attempts according to
+// a.Retry.
+func (a *Api) callEndpointRetry(ctx context.Context, ep Endpoint, body []byte, logInfo []zap.Field) ([]byte, string, error) {
+	for attempt := 0; ; attempt++ {
+		respBody, contentType, err := a.callEndpointOnce(ctx, ep, body, logInfo)
+		if err == nil || attempt >= a.Retry.Max || !a.Retry.retryable(err) || ctx.Err() != nil {
+			return respBody, contentType, err
+		}
+
+		delay := a.Retry.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			a.Log.Warn("not retrying endpoint, request deadline too close",
+				append(logInfo, zap.Int("attempt", attempt+1))...,
+			)
+			return respBody, contentType, err
+		}
+
+		endpointRetries.WithLabelValues(string(failureClass(err))).Inc()
+		a.Log.Warn("retrying endpoint request",
+			append(logInfo,
+				zap.Int("attempt", attempt+1),
+				zap.Duration("backoff", delay),
+				zap.Error(err),
+			)...,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return respBody, contentType, err
+		}
+	}
+}
+
+// callEndpointOnce makes a single attempt to call ep, bounded by
+// ep.Timeout when set.
+func (a *Api) callEndpointOnce(ctx context.Context, ep Endpoint, body []byte, logInfo []zap.Field) ([]byte, string, error) {
+	if ep.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ep.Timeout)
+		defer cancel()
+	}
+
+	if ep.audience != "" {
+		ctx = withTokenAudience(ctx, ep.audience)
+	}
+
+	if len(ep.addrs) > 0 {
+		ctx = withDialAddresses(ctx, ep.Service.Host(), ep.addrs)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewBuffer(body))
+	if err != nil {
+		a.Log.Error("Unable to build NewRequest",
+			append(logInfo, zap.Error(err))...,
+		)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: fmt.Errorf("unable to build NewRequest: %w", err)}
+	}
+
+	for k, v := range ep.Header {
+		req.Header[k] = v
+	}
+
+	if ep.signer != nil {
+		if err := ep.signer.sign(req, body); err != nil {
+			a.Log.Error("Unable to sign endpoint request",
+				append(logInfo, zap.Error(err))...,
+			)
+			return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: err}
+		}
+	}
+
+	client := a.HttpClient
+	if ep.client != nil {
+		client = ep.client
+	}
+
+	resp, err := a.Egress.client(client).Do(req)
+	var egressErr *EgressError
+	if errors.As(err, &egressErr) {
+		a.egressRejected(egressErr, logInfo)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: egressErr}
+	}
+	if err != nil {
+		a.Log.Error("Unable make endpoint request",
+			append(logInfo, zap.Error(err))...,
+		)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureTransport, Err: fmt.Errorf("unable make endpoint request: %w", err)}
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		a.Log.Error("Endpoint request returned non-200 response",
+			append(logInfo, zap.Int("http_status_code", resp.StatusCode))...,
+		)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureStatus, StatusCode: resp.StatusCode, Err: fmt.Errorf("endpoint returned non-200, got: %v", resp.StatusCode)}
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		a.Log.Error("Error reading response body",
+			append(logInfo, zap.Error(err))...,
+		)
+		return nil, "", &EndpointError{Endpoint: ep.URL, Class: FailureBody, Err: fmt.Errorf("unable to read endpoint response body: %w", err)}
+	}
+
+	return respBody, resp.Header.Get("Content-Type"), nil
+}
+
+// checkEgress returns a resolution failure when the Egress policy does
+// not permit calls to ep.
+func (a *Api) checkEgress(ep Endpoint, logInfo []zap.Field) error {
+	u, err := url.Parse(ep.URL)
+	if err != nil {
+		return &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: fmt.Errorf("unable to parse endpoint: %w", err)}
+	}
+
+	var egressErr *EgressError
+	if err := a.Egress.checkURL(u); errors.As(err, &egressErr) {
+		a.egressRejected(egressErr, logInfo)
+		return &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: egressErr}
+	}
+
+	return nil
+}
+
+// egressRejected logs and counts an endpoint call denied by the Egress
+// policy.
+func (a *Api) egressRejected(err *EgressError, logInfo []zap.Field) {
+	egressRejections.WithLabelValues(err.Reason).Inc()
+	a.Log.Warn("endpoint denied by egress policy",
+		append(logInfo, zap.String("reason", err.Reason), zap.Error(err))...,
+	)
+}
@@ -0,0 +1,209 @@
+package amp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FailureClass classifies endpoint failures so each class can have its
+// own failure policy.
+type FailureClass string
+
+const (
+	// FailureResolution is a failure to resolve endpoints or build the
+	// endpoint payload, including namespace lookups.
+	FailureResolution FailureClass = "resolution"
+
+	// FailureTransport is a failure to reach the endpoint.
+	FailureTransport FailureClass = "transport"
+
+	// FailureStatus is a non-200 endpoint response.
+	FailureStatus FailureClass = "status"
+
+	// FailureBody is an endpoint response body that can not be read,
+	// decoded or applied.
+	FailureBody FailureClass = "body"
+)
+
+// EndpointError is a failure of class Class while calling Endpoint.
+// StatusCode is the endpoint response code of a FailureStatus.
+type EndpointError struct {
+	Endpoint   string
+	Class      FailureClass
+	StatusCode int
+	Err        error
+}
+
+func (e *EndpointError) Error() string {
+	if e.Endpoint == "" {
+		return e.Err.Error()
+	}
+
+	return e.Endpoint + ": " + e.Err.Error()
+}
+
+func (e *EndpointError) Unwrap() error {
+	return e.Err
+}
+
+// failureClass returns the class of err, errors that are not an
+// EndpointError are transport failures.
+func failureClass(err error) FailureClass {
+	var epErr *EndpointError
+	if errors.As(err, &epErr) {
+		return epErr.Class
+	}
+
+	return FailureTransport
+}
+
+// FailurePolicy chooses Fail or Ignore for each FailureClass. Fail
+// denies the admission request, Ignore skips the failed endpoint and
+// adds a warning to the response. A class without a policy fails
+// validation and ignores mutation failures, so a mutation endpoint
+// that is down does not block admission.
+type FailurePolicy struct {
+	Resolution admissionregistrationv1.FailurePolicyType
+	Transport  admissionregistrationv1.FailurePolicyType
+	Status     admissionregistrationv1.FailurePolicyType
+	Body       admissionregistrationv1.FailurePolicyType
+}
+
+// For returns the policy for class in review.
+func (fp FailurePolicy) For(review AdmissionReview, class FailureClass) admissionregistrationv1.FailurePolicyType {
+	var policy admissionregistrationv1.FailurePolicyType
+	switch class {
+	case FailureResolution:
+		policy = fp.Resolution
+	case FailureTransport:
+		policy = fp.Transport
+	case FailureStatus:
+		policy = fp.Status
+	case FailureBody:
+		policy = fp.Body
+	}
+
+	if policy != "" {
+		return policy
+	}
+
+	if review == AdmissionReviewMutate {
+		return admissionregistrationv1.Ignore
+	}
+
+	return admissionregistrationv1.Fail
+}
+
+// ParseFailurePolicy parses a comma separated failure policy on top of
+// base. A bare Fail or Ignore applies to every class, class=Policy
+// applies to a single class, e.g. "Fail,transport=Ignore".
+func ParseFailurePolicy(value string, base FailurePolicy) (FailurePolicy, error) {
+	fp := base
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		class, policyValue := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			class, policyValue = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+
+		var policy admissionregistrationv1.FailurePolicyType
+		switch strings.ToLower(policyValue) {
+		case "fail":
+			policy = admissionregistrationv1.Fail
+		case "ignore":
+			policy = admissionregistrationv1.Ignore
+		default:
+			return fp, fmt.Errorf("invalid failure policy %q, expected Fail or Ignore", policyValue)
+		}
+
+		switch FailureClass(strings.ToLower(class)) {
+		case "":
+			fp = FailurePolicy{Resolution: policy, Transport: policy, Status: policy, Body: policy}
+		case FailureResolution:
+			fp.Resolution = policy
+		case FailureTransport:
+			fp.Transport = policy
+		case FailureStatus:
+			fp.Status = policy
+		case FailureBody:
+			fp.Body = policy
+		default:
+			return fp, fmt.Errorf("unknown failure class %q, expected resolution, transport, status or body", class)
+		}
+	}
+
+	return fp, nil
+}
+
+// failurePolicy returns the failure policy annotated on the namespace
+// on top of the configured default.
+func (a *Api) failurePolicy(ctx context.Context, namespace string, logInfo []zap.Field) FailurePolicy {
+	if namespace == "" {
+		return a.FailurePolicy
+	}
+
+	ns, err := a.GetNamespace(ctx, namespace)
+	if err != nil {
+		return a.FailurePolicy
+	}
+
+	value, ok := ns.GetAnnotations()[a.FailurePolicyAnnotation]
+	if !ok {
+		return a.FailurePolicy
+	}
+
+	fp, err := ParseFailurePolicy(value, a.FailurePolicy)
+	if err != nil {
+		a.Log.Warn("ignoring invalid failure policy annotation",
+			append(logInfo, zap.Error(err))...,
+		)
+		return a.FailurePolicy
+	}
+
+	return fp
+}
+
+// failure applies the failure policy to err. An ignored failure adds a
+// warning to resp and returns true, otherwise resp is set to deny the
+// request and false is returned.
+func (a *Api) failure(review AdmissionReview, fp FailurePolicy, err error, resp *admissionv1.AdmissionResponse, logInfo []zap.Field) bool {
+	class := failureClass(err)
+	policy := fp.For(review, class)
+
+	endpointFailures.WithLabelValues(string(review), string(class), string(policy)).Inc()
+
+	logInfo = append(logInfo[:len(logInfo):len(logInfo)],
+		zap.String("failure_class", string(class)),
+		zap.String("failure_policy", string(policy)),
+		zap.Error(err),
+	)
+
+	if policy == admissionregistrationv1.Ignore {
+		a.Log.Warn("ignoring failure per failure policy", logInfo...)
+		resp.Warnings = append(resp.Warnings,
+			fmt.Sprintf("amp ignored %s %s failure: %s", review, class, err.Error()))
+		return true
+	}
+
+	a.Log.Error("failing admission per failure policy", logInfo...)
+	resp.Allowed = false
+	resp.Result = &metav1.Status{
+		Code:    http.StatusInternalServerError,
+		Message: fmt.Sprintf("amp %s %s failure: %s", review, class, err.Error()),
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+package amp
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+)
+
+func TestFailurePolicyFor(t *testing.T) {
+	fail, ignore := admissionregistrationv1.Fail, admissionregistrationv1.Ignore
+
+	tests := []struct {
+		value  string
+		review AdmissionReview
+		class  FailureClass
+		want   admissionregistrationv1.FailurePolicyType
+	}{
+		{value: "", review: AdmissionReviewValidate, class: FailureTransport, want: fail},
+		{value: "", review: AdmissionReviewMutate, class: FailureTransport, want: ignore},
+		{value: "", review: AdmissionReviewMutate, class: FailureResolution, want: ignore},
+		{value: "Fail", review: AdmissionReviewMutate, class: FailureBody, want: fail},
+		{value: "Ignore", review: AdmissionReviewValidate, class: FailureStatus, want: ignore},
+		{value: "transport=Ignore", review: AdmissionReviewValidate, class: FailureTransport, want: ignore},
+		{value: "transport=Ignore", review: AdmissionReviewValidate, class: FailureStatus, want: fail},
+		{value: "transport=Fail", review: AdmissionReviewMutate, class: FailureBody, want: ignore},
+		{value: "Fail, transport=ignore", review: AdmissionReviewMutate, class: FailureTransport, want: ignore},
+		{value: "Fail, transport=ignore", review: AdmissionReviewMutate, class: FailureStatus, want: fail},
+	}
+
+	for _, tt := range tests {
+		fp, err := ParseFailurePolicy(tt.value, FailurePolicy{})
+		if err != nil {
+			t.Fatalf("ParseFailurePolicy(%q) error = %v", tt.value, err)
+		}
+		if got := fp.For(tt.review, tt.class); got != tt.want {
+			t.Errorf("ParseFailurePolicy(%q).For(%s, %s) = %s, want %s", tt.value, tt.review, tt.class, got, tt.want)
+		}
+	}
+}
+
+func TestParseFailurePolicyInvalid(t *testing.T) {
+	for _, value := range []string{"Allow", "transport", "network=Ignore", "status=Maybe"} {
+		if _, err := ParseFailurePolicy(value, FailurePolicy{}); err == nil {
+			t.Errorf("ParseFailurePolicy(%q) expected an error", value)
+		}
+	}
+}
+
+func TestIgnoredValidationFailureDoesNotVote(t *testing.T) {
+	a := &Api{Config: &Config{Log: zap.NewNop()}}
+
+	unreachable := validationResult{err: &EndpointError{Endpoint: "https://down", Class: FailureTransport, Err: errors.New("connection refused")}}
+	deny := validationResult{}
+	allow := validationResult{response: admissionv1.AdmissionResponse{Allowed: true}}
+
+	ignoreTransport, err := ParseFailurePolicy("transport=Ignore", FailurePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		fp      FailurePolicy
+		agg     Aggregation
+		results []validationResult
+		votes   int
+		want    bool
+	}{
+		{name: "any with an ignored failure", fp: ignoreTransport, agg: AggregationAny, results: []validationResult{unreachable, deny}, votes: 1, want: false},
+		{name: "quorum with an ignored failure", fp: ignoreTransport, agg: "2", results: []validationResult{unreachable, allow, deny}, votes: 2, want: false},
+		{name: "quorum capped by ignored failures", fp: ignoreTransport, agg: "2", results: []validationResult{unreachable, unreachable, allow}, votes: 1, want: true},
+		{name: "quorum capped by ignored failures with a deny", fp: ignoreTransport, agg: "2", results: []validationResult{unreachable, allow, unreachable, deny}, votes: 2, want: false},
+		{name: "quorum capped by failed failures", fp: FailurePolicy{}, agg: "2", results: []validationResult{unreachable, unreachable, allow}, votes: 3, want: false},
+		{name: "all with an ignored failure", fp: ignoreTransport, agg: AggregationAll, results: []validationResult{unreachable, allow}, votes: 1, want: true},
+		{name: "failed failure", fp: FailurePolicy{}, agg: AggregationAny, results: []validationResult{unreachable, deny}, votes: 2, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := append([]validationResult{}, tt.results...)
+			resp := &admissionv1.AdmissionResponse{}
+
+			votes := a.votes(tt.fp, results, resp, nil)
+			if len(votes) != tt.votes {
+				t.Fatalf("votes() = %d results, want %d", len(votes), tt.votes)
+			}
+
+			if got := aggregate(tt.agg.capped(len(votes)), votes).Allowed; got != tt.want {
+				t.Errorf("aggregate(%q) allowed = %v, want %v", tt.agg, got, tt.want)
+			}
+
+			if len(votes) < len(tt.results) && len(resp.Warnings) == 0 {
+				t.Errorf("votes() dropped a result without a warning")
+			}
+		})
+	}
+}
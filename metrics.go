@@ -0,0 +1,59 @@
+package amp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "amp"
+
+var (
+	namespaceCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "namespace_cache",
+		Name:      "lookups_total",
+		Help:      "Namespace lookups by result, hit is served from the informer cache, miss falls back to the API server.",
+	}, []string{"result"})
+
+	patchRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mutation",
+		Name:      "patch_rejections_total",
+		Help:      "Endpoint patches rejected by reason: invalid JSON patch, failed to apply or produced an invalid object.",
+	}, []string{"reason"})
+
+	patchViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mutation",
+		Name:      "patch_policy_violations_total",
+		Help:      "Patch operations violating the patch path policy by action taken, strip or reject.",
+	}, []string{"action"})
+
+	endpointFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "endpoint",
+		Name:      "failures_total",
+		Help:      "Endpoint failures by review type, failure class and the failure policy applied.",
+	}, []string{"review", "class", "policy"})
+
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "endpoint",
+		Name:      "circuit_state",
+		Help:      "Endpoint circuit breaker state by endpoint scheme, host and port, 0 closed, 1 open, 2 half-open.",
+	}, []string{"endpoint"})
+
+	egressRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "endpoint",
+		Name:      "egress_rejections_total",
+		Help:      "Endpoint calls denied by the egress policy by reason: scheme, host or address.",
+	}, []string{"reason"})
+
+	endpointRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "endpoint",
+		Name:      "retries_total",
+		Help:      "Endpoint call retries by the failure class of the failed attempt.",
+	}, []string{"class"})
+)
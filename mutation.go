@@ -0,0 +1,134 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// mutateWith calls the mutation endpoint ep with current, the object
+// as patched by earlier endpoints in the chain, and returns the
+// endpoint's patch along with the patched object. Endpoint failures
+// are returned as an *EndpointError. When the endpoint or the patch
+// policy denies the request reviewResponse is set to deny and a nil
+// patch is returned.
+func (a *Api) mutateWith(ctx context.Context, ep Endpoint, req *admissionv1.AdmissionRequest, current []byte, policy PatchPolicy, reviewResponse *admissionv1.AdmissionResponse, logInfo []zap.Field) (jsonpatch.Patch, []byte, error) {
+	sentReq, sent, err := a.projectRequest(ep, req, current)
+	if err != nil {
+		return nil, nil, &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: fmt.Errorf("unable to project endpoint payload: %w", err)}
+	}
+
+	body, err := a.endpointPayload(ctx, ep, sentReq, sent)
+	if err != nil {
+		return nil, nil, &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: fmt.Errorf("unable to build endpoint payload: %w", err)}
+	}
+
+	respBody, contentType, err := a.callEndpoint(ctx, ep, body, logInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// relay the response of a standard admission webhook, it may
+	// deny the request outright
+	if ep.Format == PayloadAdmissionReview {
+		resp, err := admissionReviewResponse(respBody)
+		if err != nil {
+			return nil, nil, &EndpointError{Endpoint: ep.URL, Class: FailureBody, Err: err}
+		}
+
+		mergeResponseMeta(reviewResponse, resp)
+
+		if !resp.Allowed {
+			a.Log.Info("mutation endpoint denied request", logInfo...)
+			reviewResponse.Allowed = false
+			reviewResponse.Result = resp.Result
+			return nil, nil, nil
+		}
+
+		if len(resp.Patch) == 0 {
+			return nil, current, nil
+		}
+		respBody = resp.Patch
+	} else {
+		// merge patches and full objects are converted to the
+		// equivalent JSON Patch against the object sent
+		respBody, err = toJSONPatch(responseFormat(ep, contentType), sent, respBody)
+		if err != nil {
+			return nil, nil, a.rejectPatch(ep, "invalid", fmt.Errorf("unable to convert endpoint response to a JSON patch: %w", err))
+		}
+	}
+
+	// example patch operation
+	// see: http://jsonpatch.com/
+	//
+	//po := []PatchOperation{
+	//	AddOperation("/spec/initContainers", []corev1.Container{{
+	//		Name:  "added-init-container",
+	//		Image: "alpine:3.12.0",
+	//	}}),
+	//}
+
+	// Ensure that the response body is a valid JSON Patch that
+	// applies to the object and leaves it well formed
+	if err := validatePatch(respBody); err != nil {
+		return nil, nil, a.rejectPatch(ep, "invalid", fmt.Errorf("endpoint returned an invalid JSON patch: %w", err))
+	}
+
+	patch, err := jsonpatch.DecodePatch(respBody)
+	if err != nil {
+		return nil, nil, a.rejectPatch(ep, "invalid", fmt.Errorf("unable to decode JSON patch: %w", err))
+	}
+
+	// the patch of a minimal payload is against the object sent, turn
+	// it into a patch against current keeping the stripped fields
+	if ep.Payload == PayloadMinimal {
+		patch, err = restorePatch(current, sent, patch)
+		if err != nil {
+			return nil, nil, a.rejectPatch(ep, "apply", err)
+		}
+	}
+
+	patch, violations := policy.enforce(current, patch)
+	if len(violations) > 0 {
+		patchViolations.WithLabelValues(string(policy.Action)).Add(float64(len(violations)))
+		a.Log.Warn("endpoint patch violates patch policy",
+			append(logInfo,
+				zap.Strings("violations", violations),
+				zap.String("action", string(policy.Action)),
+			)...,
+		)
+
+		if policy.Action == PolicyReject {
+			reviewResponse.Allowed = false
+			reviewResponse.Result = &metav1.Status{
+				Code:    http.StatusForbidden,
+				Message: fmt.Sprintf("mutatePod endpoint %s patch violates policy: %s", ep.URL, strings.Join(violations, ", ")),
+			}
+			return nil, nil, nil
+		}
+	}
+
+	patched, err := patch.Apply(current)
+	if err != nil {
+		return nil, nil, a.rejectPatch(ep, "apply", fmt.Errorf("unable to apply endpoint patch: %w", err))
+	}
+
+	if err := verifyPatched(current, patched); err != nil {
+		return nil, nil, a.rejectPatch(ep, "decode", err)
+	}
+
+	return patch, patched, nil
+}
+
+// rejectPatch counts an endpoint patch that was not applied and
+// returns it as a body failure.
+func (a *Api) rejectPatch(ep Endpoint, reason string, err error) error {
+	patchRejections.WithLabelValues(reason).Inc()
+	return &EndpointError{Endpoint: ep.URL, Class: FailureBody, Err: err}
+}
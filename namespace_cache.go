@@ -0,0 +1,81 @@
+package amp
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultNamespaceResync  = 10 * time.Minute
+	defaultCacheSyncTimeout = 30 * time.Second
+)
+
+// startInformers starts the shared informers used by the API and waits
+// up to CacheSyncTimeout for the namespace cache to sync. A cache that
+// fails to sync is not fatal, lookups fall back to the API server
+// until it catches up. Service and EndpointSlice informers are only
+// started for ServiceEndpointSlices, Service endpoints fail to
+// resolve until they synced.
+func (a *Api) startInformers() {
+	a.informerFactory = informers.NewSharedInformerFactory(a.Cs, a.NamespaceResync)
+
+	nsInformer := a.informerFactory.Core().V1().Namespaces()
+	a.nsLister = nsInformer.Lister()
+	a.nsSynced = nsInformer.Informer().HasSynced
+
+	synced := []cache.InformerSynced{a.nsSynced}
+
+	if a.ServiceEndpointSlices {
+		svcInformer := a.informerFactory.Core().V1().Services()
+		sliceInformer := a.informerFactory.Discovery().V1beta1().EndpointSlices()
+		a.svcLister = svcInformer.Lister()
+		a.sliceLister = sliceInformer.Lister()
+		synced = append(synced, svcInformer.Informer().HasSynced, sliceInformer.Informer().HasSynced)
+	}
+
+	a.informerFactory.Start(a.stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.CacheSyncTimeout)
+	defer cancel()
+
+	a.Log.Info("waiting for namespace cache to sync",
+		zap.Duration("timeout", a.CacheSyncTimeout))
+
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		a.Log.Warn("namespace cache did not sync, falling back to live namespace lookups until it does",
+			zap.Duration("timeout", a.CacheSyncTimeout))
+		return
+	}
+
+	a.Log.Info("namespace cache synced")
+}
+
+// GetNamespace returns the named Namespace from the informer cache,
+// falling back to a live GET against the API server on a cache miss.
+// The returned Namespace may be shared with the cache and must not be
+// modified.
+func (a *Api) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	if a.nsLister != nil && a.nsSynced() {
+		ns, err := a.nsLister.Get(name)
+		if err == nil {
+			namespaceCacheLookups.WithLabelValues("hit").Inc()
+			return ns, nil
+		}
+
+		if !apierrors.IsNotFound(err) {
+			a.Log.Warn("namespace cache lookup failed",
+				zap.String("namespace", name),
+				zap.Error(err))
+		}
+	}
+
+	namespaceCacheLookups.WithLabelValues("miss").Inc()
+	return a.Cs.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
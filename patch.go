@@ -0,0 +1,144 @@
+package amp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonPatchOps lists the operations defined by RFC 6902 and whether
+// each requires a value or a from member.
+var jsonPatchOps = map[string]struct{ value, from bool }{
+	OpAdd:     {value: true},
+	OpRemove:  {},
+	OpReplace: {value: true},
+	OpMove:    {from: true},
+	OpCopy:    {from: true},
+	OpTest:    {value: true},
+}
+
+// validatePatch strictly validates a JSON Patch (RFC 6902): the body
+// must be an array of operations, every op must be legal, path and
+// from must be RFC 6901 JSON Pointers, from must be present for move
+// and copy and value must be present for add, replace and test.
+func validatePatch(raw []byte) error {
+	var ops []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return fmt.Errorf("patch is not an array of operations: %w", err)
+	}
+
+	for i, op := range ops {
+		if err := validatePatchOperation(op); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validatePatchOperation(op map[string]json.RawMessage) error {
+	var name string
+	if err := unmarshalMember(op, "op", &name); err != nil {
+		return err
+	}
+
+	spec, ok := jsonPatchOps[name]
+	if !ok {
+		return fmt.Errorf("illegal op %q", name)
+	}
+
+	var path string
+	if err := unmarshalMember(op, "path", &path); err != nil {
+		return err
+	}
+	if err := validatePointer(path); err != nil {
+		return fmt.Errorf("%s path: %w", name, err)
+	}
+
+	if spec.from {
+		var from string
+		if err := unmarshalMember(op, "from", &from); err != nil {
+			return err
+		}
+		if err := validatePointer(from); err != nil {
+			return fmt.Errorf("%s from: %w", name, err)
+		}
+		if name == OpMove && strings.HasPrefix(path, from+"/") {
+			return fmt.Errorf("move from %q is a proper prefix of path %q", from, path)
+		}
+	}
+
+	if spec.value {
+		if _, ok := op["value"]; !ok {
+			return fmt.Errorf("%s %s has no value", name, path)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalMember unmarshals the required string member key of op.
+func unmarshalMember(op map[string]json.RawMessage, key string, v *string) error {
+	raw, ok := op[key]
+	if !ok {
+		return fmt.Errorf("missing %q", key)
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%q must be a string", key)
+	}
+
+	return nil
+}
+
+// validatePointer validates an RFC 6901 JSON Pointer, it must be empty
+// or start with / and ~ may only be escaped as ~0 or ~1.
+func validatePointer(pointer string) error {
+	if pointer == "" {
+		return nil
+	}
+
+	if pointer[0] != '/' {
+		return fmt.Errorf("pointer %q must start with /", pointer)
+	}
+
+	for i := 0; i < len(pointer); i++ {
+		if pointer[i] != '~' {
+			continue
+		}
+		if i+1 >= len(pointer) || (pointer[i+1] != '0' && pointer[i+1] != '1') {
+			return fmt.Errorf("pointer %q has an invalid ~ escape", pointer)
+		}
+	}
+
+	return nil
+}
+
+// verifyPatched verifies that patched is still a well formed object of
+// the same kind as original, decoding it into its typed Go object
+// (e.g. corev1.Pod) when the kind is registered in the scheme.
+func verifyPatched(original []byte, patched []byte) error {
+	before, err := decodeObject(original)
+	if err != nil {
+		return err
+	}
+
+	after, err := decodeObject(patched)
+	if err != nil {
+		return fmt.Errorf("patched object is invalid: %w", err)
+	}
+
+	if before.GroupVersionKind() != after.GroupVersionKind() {
+		return fmt.Errorf("patch changed kind from %s to %s", before.GroupVersionKind(), after.GroupVersionKind())
+	}
+
+	if !scheme.Recognizes(after.GroupVersionKind()) {
+		return nil
+	}
+
+	if _, _, err := codecs.UniversalDeserializer().Decode(patched, nil, nil); err != nil {
+		return fmt.Errorf("patched object does not decode into %s: %w", after.GroupVersionKind().Kind, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package amp
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// JSON Patch operations, see RFC 6902.
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+	OpMove    = "move"
+	OpCopy    = "copy"
+	OpTest    = "test"
+)
+
+// PatchOperation is a single JSON Patch (RFC 6902) operation as
+// returned by mutation endpoints.
+// see: http://jsonpatch.com/
+//
+// From is only used by move and copy. Value is always encoded for add,
+// replace and test, even when it is nil or a zero value, and never for
+// the other operations.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MarshalJSON encodes the members required by the operation.
+func (po PatchOperation) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Op    string       `json:"op"`
+		Path  string       `json:"path"`
+		From  *string      `json:"from,omitempty"`
+		Value *interface{} `json:"value,omitempty"`
+	}{Op: po.Op, Path: po.Path}
+
+	spec := jsonPatchOps[po.Op]
+	if spec.from {
+		out.From = &po.From
+	}
+	if spec.value {
+		out.Value = &po.Value
+	}
+
+	return json.Marshal(out)
+}
+
+// AddOperation adds value at path.
+func AddOperation(path string, value interface{}) PatchOperation {
+	return PatchOperation{Op: OpAdd, Path: path, Value: value}
+}
+
+// RemoveOperation removes the value at path.
+func RemoveOperation(path string) PatchOperation {
+	return PatchOperation{Op: OpRemove, Path: path}
+}
+
+// ReplaceOperation replaces the value at path with value.
+func ReplaceOperation(path string, value interface{}) PatchOperation {
+	return PatchOperation{Op: OpReplace, Path: path, Value: value}
+}
+
+// MoveOperation moves the value at from to path.
+func MoveOperation(from string, path string) PatchOperation {
+	return PatchOperation{Op: OpMove, Path: path, From: from}
+}
+
+// CopyOperation copies the value at from to path.
+func CopyOperation(from string, path string) PatchOperation {
+	return PatchOperation{Op: OpCopy, Path: path, From: from}
+}
+
+// TestOperation tests that the value at path equals value.
+func TestOperation(path string, value interface{}) PatchOperation {
+	return PatchOperation{Op: OpTest, Path: path, Value: value}
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// JSONPointer builds an RFC 6901 JSON Pointer from unescaped reference
+// tokens, e.g. JSONPointer("metadata", "annotations", "amp.txn2.com/user")
+// returns /metadata/annotations/amp.txn2.com~1user.
+func JSONPointer(tokens ...string) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteByte('/')
+		b.WriteString(pointerEscaper.Replace(t))
+	}
+
+	return b.String()
+}
+
+// PatchBuilder builds a JSON Patch for a mutation endpoint response.
+//
+//	patch := amp.NewPatchBuilder().
+//		Add("/spec/initContainers/-", container).
+//		Remove(amp.JSONPointer("metadata", "labels", "temporary"))
+//	body, err := json.Marshal(patch)
+type PatchBuilder struct {
+	ops []PatchOperation
+}
+
+// NewPatchBuilder returns an empty PatchBuilder.
+func NewPatchBuilder() *PatchBuilder {
+	return &PatchBuilder{ops: []PatchOperation{}}
+}
+
+// Add appends an add operation.
+func (pb *PatchBuilder) Add(path string, value interface{}) *PatchBuilder {
+	return pb.Operation(AddOperation(path, value))
+}
+
+// Remove appends a remove operation.
+func (pb *PatchBuilder) Remove(path string) *PatchBuilder {
+	return pb.Operation(RemoveOperation(path))
+}
+
+// Replace appends a replace operation.
+func (pb *PatchBuilder) Replace(path string, value interface{}) *PatchBuilder {
+	return pb.Operation(ReplaceOperation(path, value))
+}
+
+// Move appends a move operation.
+func (pb *PatchBuilder) Move(from string, path string) *PatchBuilder {
+	return pb.Operation(MoveOperation(from, path))
+}
+
+// Copy appends a copy operation.
+func (pb *PatchBuilder) Copy(from string, path string) *PatchBuilder {
+	return pb.Operation(CopyOperation(from, path))
+}
+
+// Test appends a test operation.
+func (pb *PatchBuilder) Test(path string, value interface{}) *PatchBuilder {
+	return pb.Operation(TestOperation(path, value))
+}
+
+// Operation appends op.
+func (pb *PatchBuilder) Operation(op PatchOperation) *PatchBuilder {
+	pb.ops = append(pb.ops, op)
+	return pb
+}
+
+// Operations returns the operations added so far.
+func (pb *PatchBuilder) Operations() []PatchOperation {
+	return pb.ops
+}
+
+// MarshalJSON encodes the patch as a JSON array of operations.
+func (pb *PatchBuilder) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pb.ops)
+}
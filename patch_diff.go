@@ -0,0 +1,164 @@
+package amp
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+// ResponseFormat is the kind of body a mutation endpoint returns.
+type ResponseFormat string
+
+const (
+	// ResponseJSONPatch is a JSON Patch (RFC 6902) array of
+	// operations, the default.
+	ResponseJSONPatch ResponseFormat = "jsonpatch"
+
+	// ResponseMergePatch is a JSON Merge Patch (RFC 7386).
+	ResponseMergePatch ResponseFormat = "mergepatch"
+
+	// ResponseObject is the complete modified object.
+	ResponseObject ResponseFormat = "object"
+)
+
+// ParseResponseFormat parses a response format, an empty value leaves
+// the format to the response Content-Type.
+func ParseResponseFormat(value string) (ResponseFormat, error) {
+	switch f := ResponseFormat(value); f {
+	case "", ResponseJSONPatch, ResponseMergePatch, ResponseObject:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown response format %q", value)
+}
+
+// responseFormat returns the format of a mutation endpoint response,
+// the endpoint option takes precedence over the Content-Type
+// application/merge-patch+json. Anything else is a JSON Patch.
+func responseFormat(ep Endpoint, contentType string) ResponseFormat {
+	if ep.Response != "" {
+		return ep.Response
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/merge-patch+json" {
+		return ResponseMergePatch
+	}
+
+	return ResponseJSONPatch
+}
+
+// toJSONPatch converts a mutation endpoint response body of the given
+// format into a JSON Patch against original.
+func toJSONPatch(format ResponseFormat, original []byte, body []byte) ([]byte, error) {
+	modified := body
+
+	switch format {
+	case ResponseJSONPatch:
+		return body, nil
+	case ResponseMergePatch:
+		var err error
+		modified, err = jsonpatch.MergePatch(original, body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply merge patch: %w", err)
+		}
+	}
+
+	ops, err := CreatePatch(original, modified)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ops)
+}
+
+// CreatePatch returns the JSON Patch operations that turn the JSON
+// document original into modified. Objects are compared member by
+// member and arrays element by element, elements beyond the length of
+// the shorter array are added or removed at the end, so the operations
+// are no wider than the change.
+func CreatePatch(original []byte, modified []byte) ([]PatchOperation, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(original, &a); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal original document: %w", err)
+	}
+	if err := json.Unmarshal(modified, &b); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal modified document: %w", err)
+	}
+
+	return diffValues("", a, b, []PatchOperation{}), nil
+}
+
+func diffValues(path string, a interface{}, b interface{}, ops []PatchOperation) []PatchOperation {
+	if as, ok := a.([]interface{}); ok {
+		if bs, ok := b.([]interface{}); ok {
+			return diffArrays(path, as, bs, ops)
+		}
+	}
+
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if reflect.DeepEqual(a, b) {
+			return ops
+		}
+		return append(ops, ReplaceOperation(path, b))
+	}
+
+	keys := make([]string, 0, len(am)+len(bm))
+	for k := range am {
+		keys = append(keys, k)
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := path + JSONPointer(k)
+		av, inA := am[k]
+		bv, inB := bm[k]
+
+		switch {
+		case !inB:
+			ops = append(ops, RemoveOperation(p))
+		case !inA:
+			ops = append(ops, AddOperation(p, bv))
+		default:
+			ops = diffValues(p, av, bv, ops)
+		}
+	}
+
+	return ops
+}
+
+// diffArrays compares the elements a and b have in common by index,
+// then adds the elements b has in addition or removes the ones it
+// lacks, last first so the indexes of the remaining ones hold.
+func diffArrays(path string, a []interface{}, b []interface{}, ops []PatchOperation) []PatchOperation {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		ops = diffValues(path+JSONPointer(strconv.Itoa(i)), a[i], b[i], ops)
+	}
+
+	for i := n; i < len(b); i++ {
+		ops = append(ops, AddOperation(path+JSONPointer(strconv.Itoa(i)), b[i]))
+	}
+
+	for i := len(a) - 1; i >= n; i-- {
+		ops = append(ops, RemoveOperation(path+JSONPointer(strconv.Itoa(i))))
+	}
+
+	return ops
+}
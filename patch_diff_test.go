@@ -0,0 +1,147 @@
+package amp
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+func TestCreatePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		want     []PatchOperation
+	}{
+		{
+			name:     "unchanged",
+			original: `{"a":[1,2],"b":{"c":"d"}}`,
+			modified: `{"a":[1,2],"b":{"c":"d"}}`,
+			want:     []PatchOperation{},
+		},
+		{
+			name:     "members",
+			original: `{"a":1,"b":2,"c~/":3}`,
+			modified: `{"a":1,"b":4,"d":5}`,
+			want: []PatchOperation{
+				ReplaceOperation("/b", float64(4)),
+				RemoveOperation("/c~0~1"),
+				AddOperation("/d", float64(5)),
+			},
+		},
+		{
+			name:     "container image",
+			original: `{"spec":{"containers":[{"name":"a","image":"nginx","env":[{"name":"DB_PASSWORD","value":"secret"}]},{"name":"b","image":"busybox"}]}}`,
+			modified: `{"spec":{"containers":[{"name":"a","image":"nginx:1.25","env":[{"name":"DB_PASSWORD","value":"secret"}]},{"name":"b","image":"busybox"}]}}`,
+			want: []PatchOperation{
+				ReplaceOperation("/spec/containers/0/image", "nginx:1.25"),
+			},
+		},
+		{
+			name:     "appended element",
+			original: `{"spec":{"containers":[{"name":"a"}]}}`,
+			modified: `{"spec":{"containers":[{"name":"a"},{"name":"sidecar"},{"name":"proxy"}]}}`,
+			want: []PatchOperation{
+				AddOperation("/spec/containers/1", map[string]interface{}{"name": "sidecar"}),
+				AddOperation("/spec/containers/2", map[string]interface{}{"name": "proxy"}),
+			},
+		},
+		{
+			name:     "removed elements",
+			original: `{"a":[1,2,3]}`,
+			modified: `{"a":[1]}`,
+			want: []PatchOperation{
+				RemoveOperation("/a/2"),
+				RemoveOperation("/a/1"),
+			},
+		},
+		{
+			name:     "array replaced by object",
+			original: `{"a":[1]}`,
+			modified: `{"a":{"b":1}}`,
+			want: []PatchOperation{
+				ReplaceOperation("/a", map[string]interface{}{"b": float64(1)}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CreatePatch([]byte(tt.original), []byte(tt.modified))
+			if err != nil {
+				t.Fatalf("CreatePatch() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CreatePatch() = %+v, want %+v", got, tt.want)
+			}
+
+			assertPatchApplies(t, tt.original, tt.modified, got)
+		})
+	}
+}
+
+// assertPatchApplies asserts that ops turn original into modified.
+func assertPatchApplies(t *testing.T, original string, modified string, ops []PatchOperation) {
+	t.Helper()
+
+	raw, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatalf("unable to marshal patch: %v", err)
+	}
+
+	patch, err := jsonpatch.DecodePatch(raw)
+	if err != nil {
+		t.Fatalf("unable to decode patch %s: %v", raw, err)
+	}
+
+	patched, err := patch.Apply([]byte(original))
+	if err != nil {
+		t.Fatalf("unable to apply patch %s: %v", raw, err)
+	}
+
+	if !jsonpatch.Equal(patched, []byte(modified)) {
+		t.Errorf("patch %s applied to %s = %s, want %s", raw, original, patched, modified)
+	}
+}
+
+func TestToJSONPatch(t *testing.T) {
+	const original = `{"metadata":{"labels":{"a":"b"}},"spec":{"containers":[{"name":"c","image":"nginx"}]}}`
+
+	tests := []struct {
+		name     string
+		format   ResponseFormat
+		body     string
+		modified string
+	}{
+		{
+			name:     "merge patch",
+			format:   ResponseMergePatch,
+			body:     `{"metadata":{"labels":{"a":null,"c":"d"}}}`,
+			modified: `{"metadata":{"labels":{"c":"d"}},"spec":{"containers":[{"name":"c","image":"nginx"}]}}`,
+		},
+		{
+			name:     "object",
+			format:   ResponseObject,
+			body:     `{"metadata":{"labels":{"a":"b"}},"spec":{"containers":[{"name":"c","image":"nginx:1.25"}]}}`,
+			modified: `{"metadata":{"labels":{"a":"b"}},"spec":{"containers":[{"name":"c","image":"nginx:1.25"}]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := toJSONPatch(tt.format, []byte(original), []byte(tt.body))
+			if err != nil {
+				t.Fatalf("toJSONPatch() error = %v", err)
+			}
+
+			var ops []PatchOperation
+			if err := json.Unmarshal(raw, &ops); err != nil {
+				t.Fatalf("toJSONPatch() = %s, not a patch: %v", raw, err)
+			}
+
+			assertPatchApplies(t, original, tt.modified, ops)
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package amp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"go.uber.org/zap"
+)
+
+// PolicyAction is taken when a patch violates a PatchPolicy.
+type PolicyAction string
+
+const (
+	// PolicyReject denies the admission request.
+	PolicyReject PolicyAction = "reject"
+
+	// PolicyStrip removes the violating operations from the patch.
+	PolicyStrip PolicyAction = "strip"
+)
+
+// ParsePolicyAction parses a policy action, an empty value is
+// PolicyReject.
+func ParsePolicyAction(value string) (PolicyAction, error) {
+	switch a := PolicyAction(strings.ToLower(strings.TrimSpace(value))); a {
+	case "":
+		return PolicyReject, nil
+	case PolicyReject, PolicyStrip:
+		return a, nil
+	}
+
+	return "", fmt.Errorf("unknown policy action %q, expected reject or strip", value)
+}
+
+// PatchPolicy restricts the JSON Pointer prefixes mutation patches may
+// modify. A prefix matches its own path and everything below it, a *
+// segment matches any single segment, e.g. /spec/containers/*/securityContext.
+type PatchPolicy struct {
+	// Allowed prefixes, when not empty every modified path must match
+	// one of them.
+	Allowed []string
+
+	// Forbidden prefixes, take precedence over Allowed.
+	Forbidden []string
+
+	// Action on violation, defaults to PolicyReject.
+	Action PolicyAction
+}
+
+// ParsePrefixes parses a comma separated list of JSON Pointer prefixes.
+func ParsePrefixes(value string) []string {
+	var prefixes []string
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return prefixes
+}
+
+// permits reports whether path may be modified.
+func (pp PatchPolicy) permits(path string) bool {
+	for _, prefix := range pp.Forbidden {
+		if pointerHasPrefix(path, prefix) {
+			return false
+		}
+	}
+
+	if len(pp.Allowed) == 0 {
+		return true
+	}
+
+	for _, prefix := range pp.Allowed {
+		if pointerHasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enforce returns the operations of patch the policy permits and a
+// description of each violation. test and copy only read their from
+// location, move also modifies it. An operation on an ancestor of a
+// forbidden prefix, up to the whole document, is applied to doc as
+// patched by the permitted operations before it and violates the
+// policy when it changes any value below the prefix.
+func (pp PatchPolicy) enforce(doc []byte, patch jsonpatch.Patch) (jsonpatch.Patch, []string) {
+	permitted := make(jsonpatch.Patch, 0, len(patch))
+	var violations []string
+
+	for _, op := range patch {
+		if op.Kind() == OpTest {
+			permitted = append(permitted, op)
+			continue
+		}
+
+		paths := []string{}
+		if path, err := op.Path(); err == nil {
+			paths = append(paths, path)
+		}
+		if op.Kind() == OpMove {
+			if from, err := op.From(); err == nil {
+				paths = append(paths, from)
+			}
+		}
+
+		ok := true
+		for _, p := range paths {
+			if !pp.permits(p) {
+				violations = append(violations, op.Kind()+" "+p)
+				ok = false
+			}
+		}
+
+		if ok && pp.coversForbidden(paths) {
+			if changed := pp.forbiddenChanges(doc, permitted, op); len(changed) > 0 {
+				violations = append(violations, op.Kind()+" "+paths[0]+" changes "+strings.Join(changed, ", "))
+				ok = false
+			}
+		}
+
+		if ok {
+			permitted = append(permitted, op)
+		}
+	}
+
+	return permitted, violations
+}
+
+// coversForbidden reports whether any of paths is an ancestor of a
+// forbidden prefix.
+func (pp PatchPolicy) coversForbidden(paths []string) bool {
+	for _, p := range paths {
+		for _, prefix := range pp.Forbidden {
+			if pointerIsAncestor(p, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// forbiddenChanges applies op to doc as patched by permitted and
+// returns the forbidden locations whose value it changes. An operation
+// that does not apply is reported as changing the whole document.
+func (pp PatchPolicy) forbiddenChanges(doc []byte, permitted jsonpatch.Patch, op jsonpatch.Operation) []string {
+	before, err := permitted.Apply(doc)
+	if err != nil {
+		return []string{"the document"}
+	}
+
+	after, err := jsonpatch.Patch{op}.Apply(before)
+	if err != nil {
+		return []string{"the document"}
+	}
+
+	beforeValues, err := pp.forbiddenValues(before)
+	if err != nil {
+		return []string{"the document"}
+	}
+
+	afterValues, err := pp.forbiddenValues(after)
+	if err != nil {
+		return []string{"the document"}
+	}
+
+	var changed []string
+	for p, v := range beforeValues {
+		if av, ok := afterValues[p]; !ok || !reflect.DeepEqual(v, av) {
+			changed = append(changed, p)
+		}
+	}
+	for p := range afterValues {
+		if _, ok := beforeValues[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+// forbiddenValues returns the values of the JSON document doc at the
+// forbidden prefixes keyed by their JSON Pointer.
+func (pp PatchPolicy) forbiddenValues(doc []byte) (map[string]interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	for _, prefix := range pp.Forbidden {
+		collectPointerValues(v, "", pointerTokens(prefix), values)
+	}
+
+	return values, nil
+}
+
+// collectPointerValues adds the values at tokens below v, found at
+// path, to values. * tokens match any key or index.
+func collectPointerValues(v interface{}, path string, tokens []string, values map[string]interface{}) {
+	if len(tokens) == 0 {
+		values[path] = v
+		return
+	}
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for k, child := range c {
+			if tokens[0] == "*" || tokens[0] == k {
+				collectPointerValues(child, path+JSONPointer(k), tokens[1:], values)
+			}
+		}
+	case []interface{}:
+		for i, child := range c {
+			if tokens[0] == "*" || tokens[0] == strconv.Itoa(i) {
+				collectPointerValues(child, path+JSONPointer(strconv.Itoa(i)), tokens[1:], values)
+			}
+		}
+	}
+}
+
+// pointerHasPrefix reports whether the JSON Pointer path equals prefix
+// or is below it, * segments in prefix match any segment.
+func pointerHasPrefix(path string, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+
+	pathSegs := strings.Split(path, "/")
+	prefixSegs := strings.Split(prefix, "/")
+	if len(pathSegs) < len(prefixSegs) {
+		return false
+	}
+
+	for i, seg := range prefixSegs {
+		if seg != "*" && seg != pathSegs[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pointerIsAncestor reports whether the JSON Pointer path is above
+// prefix, * segments in prefix match any segment. The root "" is an
+// ancestor of every other prefix.
+func pointerIsAncestor(path string, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return false
+	}
+
+	if path == "" {
+		return true
+	}
+
+	pathSegs := strings.Split(path, "/")
+	prefixSegs := strings.Split(prefix, "/")
+	if len(pathSegs) >= len(prefixSegs) {
+		return false
+	}
+
+	for i, seg := range pathSegs {
+		if prefixSegs[i] != "*" && prefixSegs[i] != seg {
+			return false
+		}
+	}
+
+	return true
+}
+
+// patchPolicy returns the global PatchPolicy combined with the policy
+// annotated on the namespace. Namespace forbidden prefixes are added to
+// the global ones, namespace allowed prefixes further restrict the
+// global ones and the namespace may choose the action.
+func (a *Api) patchPolicy(ctx context.Context, namespace string, logInfo []zap.Field) PatchPolicy {
+	pp := a.PatchPolicy
+	if pp.Action == "" {
+		pp.Action = PolicyReject
+	}
+
+	if namespace == "" {
+		return pp
+	}
+
+	ns, err := a.GetNamespace(ctx, namespace)
+	if err != nil {
+		return pp
+	}
+
+	annotations := ns.GetAnnotations()
+
+	if v, ok := annotations[a.PatchDenyAnnotation]; ok {
+		pp.Forbidden = append(append([]string{}, pp.Forbidden...), ParsePrefixes(v)...)
+	}
+
+	if v, ok := annotations[a.PatchAllowAnnotation]; ok {
+		nsAllowed := ParsePrefixes(v)
+		if len(pp.Allowed) == 0 {
+			pp.Allowed = nsAllowed
+		} else {
+			// a path must satisfy both the global and namespace
+			// allowlists, keep the narrower of each overlapping pair
+			var allowed []string
+			for _, n := range nsAllowed {
+				for _, g := range pp.Allowed {
+					switch {
+					case pointerHasPrefix(n, g):
+						allowed = append(allowed, n)
+					case pointerHasPrefix(g, n):
+						allowed = append(allowed, g)
+					}
+				}
+			}
+			if len(allowed) == 0 {
+				// nothing is allowed by both, forbid everything
+				pp.Forbidden = append(append([]string{}, pp.Forbidden...), "/")
+			}
+			pp.Allowed = allowed
+		}
+	}
+
+	if v, ok := annotations[a.PatchViolationAnnotation]; ok {
+		action, err := ParsePolicyAction(v)
+		if err != nil {
+			a.Log.Warn("ignoring invalid patch violation annotation",
+				append(logInfo, zap.Error(err))...,
+			)
+		} else {
+			pp.Action = action
+		}
+	}
+
+	return pp
+}
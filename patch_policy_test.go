@@ -0,0 +1,234 @@
+package amp
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+func TestPatchPolicyPermits(t *testing.T) {
+	pp := PatchPolicy{
+		Allowed:   []string{"/metadata/labels", "/spec/containers"},
+		Forbidden: []string{"/spec/containers/*/securityContext"},
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/metadata/labels", want: true},
+		{path: "/metadata/labels/app", want: true},
+		{path: "/metadata/labelsx", want: false},
+		{path: "/metadata/annotations/a", want: false},
+		{path: "/spec/containers/0/image", want: true},
+		{path: "/spec/containers/0/securityContext", want: false},
+		{path: "/spec/containers/1/securityContext/privileged", want: false},
+		{path: "/spec", want: false},
+		{path: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := pp.permits(tt.path); got != tt.want {
+			t.Errorf("permits(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPatchPolicyEnforce(t *testing.T) {
+	const pod = `{"metadata":{"labels":{"app":"a"}},"spec":{"hostNetwork":false,"containers":[{"name":"c","image":"nginx","securityContext":{"privileged":false}}]}}`
+
+	forbidden := PatchPolicy{Forbidden: []string{"/spec/hostNetwork", "/spec/containers/*/securityContext"}}
+
+	tests := []struct {
+		name       string
+		policy     PatchPolicy
+		patch      string
+		permitted  int
+		violations int
+	}{
+		{
+			name:      "permitted path",
+			policy:    forbidden,
+			patch:     `[{"op":"add","path":"/metadata/labels/b","value":"c"}]`,
+			permitted: 1,
+		},
+		{
+			name:       "forbidden path",
+			policy:     forbidden,
+			patch:      `[{"op":"replace","path":"/spec/hostNetwork","value":true}]`,
+			violations: 1,
+		},
+		{
+			name:       "below forbidden path",
+			policy:     forbidden,
+			patch:      `[{"op":"replace","path":"/spec/containers/0/securityContext/privileged","value":true}]`,
+			violations: 1,
+		},
+		{
+			name:       "ancestor changing a forbidden value",
+			policy:     forbidden,
+			patch:      `[{"op":"replace","path":"/spec","value":{"hostNetwork":true,"containers":[{"name":"c","image":"nginx","securityContext":{"privileged":false}}]}}]`,
+			violations: 1,
+		},
+		{
+			name:       "ancestor adding a forbidden value",
+			policy:     PatchPolicy{Forbidden: []string{"/spec/hostPID"}},
+			patch:      `[{"op":"add","path":"/spec","value":{"hostPID":true}}]`,
+			violations: 1,
+		},
+		{
+			name:       "ancestor removing a forbidden value",
+			policy:     forbidden,
+			patch:      `[{"op":"remove","path":"/spec"}]`,
+			violations: 1,
+		},
+		{
+			name:       "root changing a forbidden value",
+			policy:     forbidden,
+			patch:      `[{"op":"replace","path":"","value":{"spec":{"hostNetwork":true}}}]`,
+			violations: 1,
+		},
+		{
+			name:       "wildcard ancestor changing a forbidden value",
+			policy:     forbidden,
+			patch:      `[{"op":"replace","path":"/spec/containers/0","value":{"name":"c","image":"nginx","securityContext":{"privileged":true}}}]`,
+			violations: 1,
+		},
+		{
+			name:      "ancestor keeping forbidden values",
+			policy:    forbidden,
+			patch:     `[{"op":"replace","path":"/spec/containers/0","value":{"name":"c","image":"nginx:1.25","securityContext":{"privileged":false}}}]`,
+			permitted: 1,
+		},
+		{
+			name:       "move from an ancestor",
+			policy:     forbidden,
+			patch:      `[{"op":"move","from":"/spec","path":"/metadata/spec"}]`,
+			violations: 1,
+		},
+		{
+			name:       "copy over an ancestor",
+			policy:     forbidden,
+			patch:      `[{"op":"add","path":"/metadata/spec","value":{"hostNetwork":true}},{"op":"copy","from":"/metadata/spec","path":"/spec"}]`,
+			permitted:  1,
+			violations: 1,
+		},
+		{
+			name:       "ancestor after an earlier operation",
+			policy:     forbidden,
+			patch:      `[{"op":"remove","path":"/metadata/labels/app"},{"op":"replace","path":"/spec/containers","value":[]}]`,
+			permitted:  1,
+			violations: 1,
+		},
+		{
+			name:      "test is permitted",
+			policy:    forbidden,
+			patch:     `[{"op":"test","path":"/spec/hostNetwork","value":false}]`,
+			permitted: 1,
+		},
+		{
+			name:       "outside the allowlist",
+			policy:     PatchPolicy{Allowed: []string{"/metadata/labels"}},
+			patch:      `[{"op":"add","path":"/metadata/labels/b","value":"c"},{"op":"replace","path":"/metadata","value":{}}]`,
+			permitted:  1,
+			violations: 1,
+		},
+		{
+			name:       "everything forbidden",
+			policy:     PatchPolicy{Forbidden: []string{"/"}},
+			patch:      `[{"op":"add","path":"/metadata/labels/b","value":"c"}]`,
+			violations: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := jsonpatch.DecodePatch([]byte(tt.patch))
+			if err != nil {
+				t.Fatalf("unable to decode patch: %v", err)
+			}
+
+			permitted, violations := tt.policy.enforce([]byte(pod), patch)
+			if len(permitted) != tt.permitted || len(violations) != tt.violations {
+				t.Errorf("enforce() permitted %d operations with violations %q, want %d permitted and %d violations",
+					len(permitted), violations, tt.permitted, tt.violations)
+			}
+
+			// the permitted operations must leave the forbidden values
+			// unchanged
+			patched, err := permitted.Apply([]byte(pod))
+			if err != nil {
+				t.Fatalf("unable to apply permitted operations: %v", err)
+			}
+
+			before, _ := tt.policy.forbiddenValues([]byte(pod))
+			after, _ := tt.policy.forbiddenValues(patched)
+			b, _ := json.Marshal(before)
+			a, _ := json.Marshal(after)
+			if len(tt.policy.Forbidden) > 0 && string(b) != string(a) {
+				t.Errorf("permitted operations changed forbidden values from %s to %s", b, a)
+			}
+		})
+	}
+}
+
+func TestPointerIsAncestor(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{path: "", prefix: "/spec/hostNetwork", want: true},
+		{path: "/spec", prefix: "/spec/hostNetwork", want: true},
+		{path: "/spec/containers", prefix: "/spec/containers/*/securityContext", want: true},
+		{path: "/spec/containers/3", prefix: "/spec/containers/*/securityContext", want: true},
+		{path: "/spec/hostNetwork", prefix: "/spec/hostNetwork", want: false},
+		{path: "/spec/hostNetwork/x", prefix: "/spec/hostNetwork", want: false},
+		{path: "/metadata", prefix: "/spec/hostNetwork", want: false},
+		{path: "/spe", prefix: "/spec/hostNetwork", want: false},
+		{path: "", prefix: "/", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := pointerIsAncestor(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("pointerIsAncestor(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPatchPolicyNamespace(t *testing.T) {
+	a := newTestApi(t, map[string]interface{}{
+		"/api/v1/namespaces/disjoint": testNamespace("disjoint", map[string]string{defaultPatchAllowAnnotation: "/spec"}),
+		"/api/v1/namespaces/deny":     testNamespace("deny", map[string]string{defaultPatchDenyAnnotation: "/spec/volumes"}),
+	})
+	a.PatchAllowAnnotation = defaultPatchAllowAnnotation
+	a.PatchDenyAnnotation = defaultPatchDenyAnnotation
+	a.PatchViolationAnnotation = defaultPatchViolationAnnotation
+
+	// spare capacity a namespace policy must not write into
+	forbidden := make([]string, 1, 4)
+	forbidden[0] = "/metadata/labels"
+	a.PatchPolicy = PatchPolicy{Allowed: []string{"/metadata"}, Forbidden: forbidden}
+
+	tests := []struct {
+		namespace string
+		want      []string
+	}{
+		{namespace: "disjoint", want: []string{"/metadata/labels", "/"}},
+		{namespace: "deny", want: []string{"/metadata/labels", "/spec/volumes"}},
+	}
+
+	for _, tt := range tests {
+		pp := a.patchPolicy(context.Background(), tt.namespace, nil)
+		if !reflect.DeepEqual(pp.Forbidden, tt.want) {
+			t.Errorf("patchPolicy(%q) forbidden = %v, want %v", tt.namespace, pp.Forbidden, tt.want)
+		}
+
+		if got := forbidden[:cap(forbidden)][1]; got != "" {
+			t.Errorf("patchPolicy(%q) wrote %q into the global forbidden prefixes", tt.namespace, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package amp
+
+import "testing"
+
+func TestValidatePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		wantErr bool
+	}{
+		{name: "empty", patch: `[]`},
+		{name: "add", patch: `[{"op":"add","path":"/metadata/labels/a","value":"b"}]`},
+		{name: "add null value", patch: `[{"op":"add","path":"/spec/x","value":null}]`},
+		{name: "remove", patch: `[{"op":"remove","path":"/metadata/labels/a"}]`},
+		{name: "replace root", patch: `[{"op":"replace","path":"","value":{}}]`},
+		{name: "move", patch: `[{"op":"move","from":"/a","path":"/b"}]`},
+		{name: "copy", patch: `[{"op":"copy","from":"/a","path":"/a/b"}]`},
+		{name: "test", patch: `[{"op":"test","path":"/a","value":1}]`},
+		{name: "escaped pointer", patch: `[{"op":"remove","path":"/metadata/annotations/a~1b~0c"}]`},
+		{name: "not an array", patch: `{"op":"add","path":"/a","value":1}`, wantErr: true},
+		{name: "not json", patch: `[`, wantErr: true},
+		{name: "illegal op", patch: `[{"op":"merge","path":"/a","value":1}]`, wantErr: true},
+		{name: "missing op", patch: `[{"path":"/a","value":1}]`, wantErr: true},
+		{name: "op not a string", patch: `[{"op":1,"path":"/a"}]`, wantErr: true},
+		{name: "missing path", patch: `[{"op":"remove"}]`, wantErr: true},
+		{name: "relative path", patch: `[{"op":"remove","path":"a"}]`, wantErr: true},
+		{name: "invalid escape", patch: `[{"op":"remove","path":"/a~2"}]`, wantErr: true},
+		{name: "trailing tilde", patch: `[{"op":"remove","path":"/a~"}]`, wantErr: true},
+		{name: "add without value", patch: `[{"op":"add","path":"/a"}]`, wantErr: true},
+		{name: "replace without value", patch: `[{"op":"replace","path":"/a"}]`, wantErr: true},
+		{name: "test without value", patch: `[{"op":"test","path":"/a"}]`, wantErr: true},
+		{name: "move without from", patch: `[{"op":"move","path":"/a"}]`, wantErr: true},
+		{name: "copy invalid from", patch: `[{"op":"copy","from":"a","path":"/b"}]`, wantErr: true},
+		{name: "move into itself", patch: `[{"op":"move","from":"/a","path":"/a/b"}]`, wantErr: true},
+		{name: "second op invalid", patch: `[{"op":"remove","path":"/a"},{"op":"add","path":"/b"}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePatch([]byte(tt.patch))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePatch(%s) error = %v, wantErr %v", tt.patch, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyPatched(t *testing.T) {
+	const pod = `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p"},"spec":{"containers":[{"name":"c","image":"nginx"}]}}`
+
+	tests := []struct {
+		name    string
+		patched string
+		wantErr bool
+	}{
+		{name: "unchanged", patched: pod},
+		{name: "image changed", patched: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p"},"spec":{"containers":[{"name":"c","image":"busybox"}]}}`},
+		{name: "kind changed", patched: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"p"}}`, wantErr: true},
+		{name: "version changed", patched: `{"apiVersion":"v2","kind":"Pod","metadata":{"name":"p"}}`, wantErr: true},
+		{name: "kind removed", patched: `{"apiVersion":"v1","metadata":{"name":"p"}}`, wantErr: true},
+		{name: "not an object", patched: `[]`, wantErr: true},
+		{name: "wrong field type", patched: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p"},"spec":{"containers":"nginx"}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPatched([]byte(pod), []byte(tt.patched))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyPatched() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyPatchedUnregisteredKind(t *testing.T) {
+	const widget = `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"w"},"spec":{"size":1}}`
+	const patched = `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"w"},"spec":{"size":"large"}}`
+
+	if err := verifyPatched([]byte(widget), []byte(patched)); err != nil {
+		t.Errorf("verifyPatched() of an unregistered kind error = %v", err)
+	}
+}
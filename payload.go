@@ -0,0 +1,190 @@
+package amp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// PayloadFormat selects the body amp POSTs to an endpoint.
+type PayloadFormat string
+
+const (
+	// PayloadLegacy sends the bare object, or on DELETE the object
+	// being deleted. It is the format existing endpoints such as
+	// amp-wh-example expect, endpoints needing the operation, old
+	// object or options use PayloadEnvelope.
+	PayloadLegacy PayloadFormat = "legacy"
+
+	// PayloadEnvelope sends an EndpointRequest.
+	PayloadEnvelope PayloadFormat = "envelope"
+
+	// PayloadAdmissionReview forwards the admission.k8s.io/v1
+	// AdmissionReview as received and expects an AdmissionReview in
+	// return, for endpoints that are standard admission webhooks. The
+	// returned patch, warnings, audit annotations and status are
+	// relayed to Kubernetes.
+	PayloadAdmissionReview PayloadFormat = "admissionreview"
+)
+
+// ParsePayloadFormat parses a payload format, an empty value is
+// PayloadLegacy.
+func ParsePayloadFormat(value string) (PayloadFormat, error) {
+	switch f := PayloadFormat(value); f {
+	case "":
+		return PayloadLegacy, nil
+	case PayloadLegacy, PayloadEnvelope, PayloadAdmissionReview:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown payload format %q", value)
+}
+
+// PayloadProjection selects how much of the object under review is
+// sent to an endpoint.
+type PayloadProjection string
+
+const (
+	// PayloadFull sends the object as received.
+	PayloadFull PayloadProjection = "full"
+
+	// PayloadMinimal strips the managed fields, the status and every
+	// field redacted by the RedactionPolicy from the object and old
+	// object sent, for endpoints that do not need them.
+	PayloadMinimal PayloadProjection = "minimal"
+)
+
+// ParsePayloadProjection parses a payload projection, an empty value
+// is PayloadFull.
+func ParsePayloadProjection(value string) (PayloadProjection, error) {
+	switch p := PayloadProjection(value); p {
+	case "":
+		return PayloadFull, nil
+	case PayloadFull, PayloadMinimal:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown payload projection %q", value)
+}
+
+// EndpointRequestVersion is the current version of EndpointRequest.
+const EndpointRequestVersion = "amp.txn2.com/v1"
+
+// EndpointRequest is the envelope POSTed to PayloadEnvelope endpoints.
+// It carries the full admission context of the object under review.
+type EndpointRequest struct {
+	// Version is EndpointRequestVersion.
+	Version string `json:"version"`
+
+	// Request is the admission request including the operation, kind,
+	// resource, UserInfo, DryRun and Options. Its Object and OldObject
+	// are cleared in favor of the fields below.
+	Request *admissionv1.AdmissionRequest `json:"request"`
+
+	// Namespace is the metadata of the request's Namespace, empty for
+	// cluster scoped resources.
+	Namespace *metav1.ObjectMeta `json:"namespace,omitempty"`
+
+	// Object is the object under review, including any patches applied
+	// by earlier endpoints in a mutation chain. Empty on DELETE.
+	Object runtime.RawExtension `json:"object"`
+
+	// OldObject is the existing object for UPDATE and DELETE.
+	OldObject runtime.RawExtension `json:"oldObject"`
+}
+
+// endpointPayload builds the body POSTed to ep for req with object as
+// the current state of the object under review.
+func (a *Api) endpointPayload(ctx context.Context, ep Endpoint, req *admissionv1.AdmissionRequest, object []byte) ([]byte, error) {
+	switch ep.Format {
+	case PayloadEnvelope:
+		return a.envelopePayload(ctx, req, object)
+	case PayloadAdmissionReview:
+		return admissionReviewPayload(req, object)
+	}
+
+	if len(object) == 0 {
+		return req.OldObject.Raw, nil
+	}
+
+	return object, nil
+}
+
+func (a *Api) envelopePayload(ctx context.Context, req *admissionv1.AdmissionRequest, object []byte) ([]byte, error) {
+	er := EndpointRequest{
+		Version:   EndpointRequestVersion,
+		Request:   req.DeepCopy(),
+		Object:    runtime.RawExtension{Raw: object},
+		OldObject: req.OldObject,
+	}
+	er.Request.Object = runtime.RawExtension{}
+	er.Request.OldObject = runtime.RawExtension{}
+
+	if req.Namespace != "" {
+		ns, err := a.GetNamespace(ctx, req.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get namespace %s: %w", req.Namespace, err)
+		}
+
+		er.Namespace = ns.ObjectMeta.DeepCopy()
+		er.Namespace.ManagedFields = nil
+	}
+
+	return json.Marshal(er)
+}
+
+// admissionReviewPayload rebuilds the AdmissionReview for req. object
+// replaces the request object so later endpoints in a mutation chain
+// see earlier patches, for the first endpoint it is unchanged.
+func admissionReviewPayload(req *admissionv1.AdmissionRequest, object []byte) ([]byte, error) {
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AdmissionReview",
+			APIVersion: admissionv1.SchemeGroupVersion.String(),
+		},
+		Request: req,
+	}
+
+	if len(object) > 0 {
+		review.Request = req.DeepCopy()
+		review.Request.Object = runtime.RawExtension{Raw: object}
+	}
+
+	return json.Marshal(review)
+}
+
+// admissionReviewResponse returns the response of an AdmissionReview
+// returned by a PayloadAdmissionReview endpoint.
+func admissionReviewResponse(body []byte) (*admissionv1.AdmissionResponse, error) {
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal response body into admissionv1.AdmissionReview: %w", err)
+	}
+
+	if review.Response == nil {
+		return nil, errors.New("endpoint AdmissionReview has no response")
+	}
+
+	return review.Response, nil
+}
+
+// reviewObject decodes the object under review, falling back to the
+// old object for DELETE requests which carry no object.
+func reviewObject(req *admissionv1.AdmissionRequest) (*unstructured.Unstructured, error) {
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+
+	if len(raw) == 0 {
+		return nil, errors.New("admission request has no object or oldObject")
+	}
+
+	return decodeObject(raw)
+}
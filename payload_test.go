@@ -0,0 +1,67 @@
+package amp
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestEndpointPayload(t *testing.T) {
+	a := newTestApi(t, map[string]interface{}{
+		"/api/v1/namespaces/team-a": testNamespace("team-a", nil),
+	})
+
+	const object, oldObject = `{"kind":"Pod","spec":{"image":"app:2"}}`, `{"kind":"Pod","spec":{"image":"app:1"}}`
+	options := runtime.RawExtension{Raw: []byte(`{"kind":"UpdateOptions"}`)}
+
+	tests := []struct {
+		operation admissionv1.Operation
+		object    string
+		want      string
+	}{
+		{operation: admissionv1.Create, object: object, want: object},
+		{operation: admissionv1.Update, object: object, want: object},
+		{operation: admissionv1.Delete, want: oldObject},
+		{operation: admissionv1.Connect, object: `{"kind":"PodExecOptions"}`, want: `{"kind":"PodExecOptions"}`},
+	}
+
+	for _, tt := range tests {
+		// DELETE requests carry no object
+		var obj []byte
+		if tt.object != "" {
+			obj = []byte(tt.object)
+		}
+
+		req := &admissionv1.AdmissionRequest{
+			Namespace: "team-a",
+			Operation: tt.operation,
+			Object:    runtime.RawExtension{Raw: obj},
+			OldObject: runtime.RawExtension{Raw: []byte(oldObject)},
+			Options:   options,
+		}
+
+		got, err := a.endpointPayload(context.Background(), Endpoint{Format: PayloadLegacy}, req, obj)
+		if err != nil {
+			t.Fatalf("endpointPayload(%s) error = %v", tt.operation, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("legacy endpointPayload(%s) = %s, want %s", tt.operation, got, tt.want)
+		}
+
+		body, err := a.endpointPayload(context.Background(), Endpoint{Format: PayloadEnvelope}, req, obj)
+		if err != nil {
+			t.Fatalf("envelope endpointPayload(%s) error = %v", tt.operation, err)
+		}
+
+		var er EndpointRequest
+		if err := json.Unmarshal(body, &er); err != nil {
+			t.Fatalf("unable to decode envelope %s: %v", body, err)
+		}
+		if er.Request.Operation != tt.operation || string(er.OldObject.Raw) != oldObject || string(er.Request.Options.Raw) != string(options.Raw) {
+			t.Errorf("envelope endpointPayload(%s) = %s, want the operation, old object and options", tt.operation, body)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package amp
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// redactedValue replaces redacted values in logs.
+const redactedValue = "[REDACTED]"
+
+// RedactionPolicy masks sensitive fields of objects in logs and strips
+// them from PayloadMinimal endpoint payloads. The zero value redacts
+// nothing.
+type RedactionPolicy struct {
+	// Paths are JSON Pointers of redacted fields, a * token matches
+	// any key or index, e.g.
+	// /metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration
+	// or /spec/containers/*/args. Everything below a path is redacted.
+	Paths []string
+
+	// EnvNames are case insensitive glob patterns (see path.Match) of
+	// container environment variables whose value is redacted, e.g.
+	// *PASSWORD* or *_TOKEN.
+	EnvNames []string
+}
+
+func (rp RedactionPolicy) enabled() bool {
+	return len(rp.Paths) > 0 || len(rp.EnvNames) > 0
+}
+
+// redact masks, or with remove deletes, the redacted fields of the
+// decoded JSON document v in place.
+func (rp RedactionPolicy) redact(v interface{}, remove bool) {
+	for _, p := range rp.Paths {
+		redactPointer(v, pointerTokens(p), remove)
+	}
+
+	if len(rp.EnvNames) > 0 {
+		rp.redactEnv(v, remove)
+	}
+}
+
+// redactPointer redacts the values at tokens below v. Map keys are
+// deleted with remove, array elements are always masked to keep the
+// indexes of the elements that follow.
+func redactPointer(v interface{}, tokens []string, remove bool) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for k, child := range c {
+			if tokens[0] != "*" && tokens[0] != k {
+				continue
+			}
+			if len(tokens) > 1 {
+				redactPointer(child, tokens[1:], remove)
+			} else if remove {
+				delete(c, k)
+			} else {
+				c[k] = redactedValue
+			}
+		}
+	case []interface{}:
+		for i, child := range c {
+			if tokens[0] != "*" && tokens[0] != strconv.Itoa(i) {
+				continue
+			}
+			if len(tokens) > 1 {
+				redactPointer(child, tokens[1:], remove)
+			} else {
+				c[i] = redactedValue
+			}
+		}
+	}
+}
+
+// redactEnv redacts the value of every environment variable matching
+// EnvNames in any env list below v, which covers the containers of
+// Pods and of the Pod templates of workload resources.
+func (rp RedactionPolicy) redactEnv(v interface{}, remove bool) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for k, child := range c {
+			if env, ok := child.([]interface{}); ok && k == "env" {
+				for _, e := range env {
+					rp.redactEnvVar(e, remove)
+				}
+				continue
+			}
+			rp.redactEnv(child, remove)
+		}
+	case []interface{}:
+		for _, child := range c {
+			rp.redactEnv(child, remove)
+		}
+	}
+}
+
+func (rp RedactionPolicy) redactEnvVar(v interface{}, remove bool) {
+	envVar, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	name, _ := envVar["name"].(string)
+	if _, ok := envVar["value"]; !ok || !rp.envNameRedacted(name) {
+		return
+	}
+
+	if remove {
+		delete(envVar, "value")
+	} else {
+		envVar["value"] = redactedValue
+	}
+}
+
+func (rp RedactionPolicy) envNameRedacted(name string) bool {
+	name = strings.ToUpper(name)
+	for _, p := range rp.EnvNames {
+		if ok, _ := path.Match(strings.ToUpper(p), name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactReview returns the raw AdmissionReview body with the redacted
+// fields of its object and old object masked, nil when the body is not
+// valid JSON.
+func (rp RedactionPolicy) redactReview(raw []byte) []byte {
+	if !rp.enabled() || len(raw) == 0 {
+		return raw
+	}
+
+	var review map[string]interface{}
+	if err := json.Unmarshal(raw, &review); err != nil {
+		return nil
+	}
+
+	if req, ok := review["request"].(map[string]interface{}); ok {
+		rp.redact(req["object"], false)
+		rp.redact(req["oldObject"], false)
+	}
+
+	redacted, err := json.Marshal(review)
+	if err != nil {
+		return nil
+	}
+
+	return redacted
+}
+
+// redactMetadata returns a copy of the labels or annotations (field)
+// of an object with the redacted values masked.
+func (rp RedactionPolicy) redactMetadata(field string, values map[string]string) map[string]string {
+	if len(rp.Paths) == 0 || len(values) == 0 {
+		return values
+	}
+
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+
+	doc := map[string]interface{}{"metadata": map[string]interface{}{field: m}}
+	for _, p := range rp.Paths {
+		redactPointer(doc, pointerTokens(p), false)
+	}
+
+	redacted := make(map[string]string, len(m))
+	for k, v := range m {
+		redacted[k], _ = v.(string)
+	}
+
+	return redacted
+}
+
+// redactPatch returns a JSON patch with the redacted fields of its
+// operation values masked, nil when it is not a valid JSON patch. The
+// variable an env value belongs to is not known from the patch, so
+// values set directly at an env value path are always masked when
+// EnvNames are set.
+func (rp RedactionPolicy) redactPatch(raw []byte) []byte {
+	if !rp.enabled() || len(raw) == 0 {
+		return raw
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return nil
+	}
+
+	for _, op := range ops {
+		value, ok := op["value"]
+		if !ok {
+			continue
+		}
+
+		p, _ := op["path"].(string)
+		tokens := pointerTokens(p)
+
+		op["value"] = rp.redactOperationValue(tokens, value)
+	}
+
+	redacted, err := json.Marshal(ops)
+	if err != nil {
+		return nil
+	}
+
+	return redacted
+}
+
+// redactOperationValue redacts the value a patch operation sets at the
+// pointer tokens.
+func (rp RedactionPolicy) redactOperationValue(tokens []string, value interface{}) interface{} {
+	for _, p := range rp.Paths {
+		pTokens := pointerTokens(p)
+		if tokensMatch(pTokens, tokens) {
+			return redactedValue
+		}
+		if len(tokens) < len(pTokens) && tokensMatch(pTokens[:len(tokens)], tokens) {
+			redactPointer(value, pTokens[len(tokens):], false)
+		}
+	}
+
+	if len(rp.EnvNames) == 0 || len(tokens) == 0 {
+		return value
+	}
+
+	n := len(tokens)
+	switch {
+	case n >= 3 && tokens[n-3] == "env" && tokens[n-1] == "value":
+		return redactedValue
+	case n >= 2 && tokens[n-2] == "env":
+		rp.redactEnvVar(value, false)
+	default:
+		rp.redactEnv(map[string]interface{}{tokens[n-1]: value}, false)
+	}
+
+	return value
+}
+
+// tokensMatch reports whether prefix, which may contain * tokens,
+// matches the start of tokens.
+func tokensMatch(prefix []string, tokens []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+
+	for i, t := range prefix {
+		if t != "*" && t != tokens[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// pointerTokens splits a JSON Pointer into its unescaped tokens.
+func pointerTokens(pointer string) []string {
+	if pointer == "" || pointer == "/" {
+		return nil
+	}
+
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, t := range tokens {
+		tokens[i] = pointerUnescaper.Replace(t)
+	}
+
+	return tokens
+}
+
+// minimalObject strips the managed fields, the status and the fields
+// redacted by the policy from a JSON encoded object.
+func (rp RedactionPolicy) minimalObject(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "managedFields")
+	}
+	delete(obj, "status")
+
+	rp.redact(obj, true)
+
+	return json.Marshal(obj)
+}
+
+// projectRequest returns req and object, the current state of the
+// object under review, as sent to ep. For PayloadMinimal endpoints
+// both the object and the old object are reduced to minimalObject.
+func (a *Api) projectRequest(ep Endpoint, req *admissionv1.AdmissionRequest, object []byte) (*admissionv1.AdmissionRequest, []byte, error) {
+	if ep.Payload != PayloadMinimal {
+		return req, object, nil
+	}
+
+	object, err := a.Redaction.minimalObject(object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	projected := req.DeepCopy()
+	if projected.Object.Raw, err = a.Redaction.minimalObject(req.Object.Raw); err != nil {
+		return nil, nil, err
+	}
+	if projected.OldObject.Raw, err = a.Redaction.minimalObject(req.OldObject.Raw); err != nil {
+		return nil, nil, err
+	}
+
+	return projected, object, nil
+}
+
+// restorePatch turns patch, returned by a PayloadMinimal endpoint for
+// sent, the minimalObject of current, into a patch against current.
+// The patched object gets back the fields stripped from sent, see
+// restoreStripped, so the endpoint can not remove or overwrite them
+// with placeholders.
+func restorePatch(current []byte, sent []byte, patch jsonpatch.Patch) (jsonpatch.Patch, error) {
+	modified, err := patch.Apply(sent)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply endpoint patch to the object sent: %w", err)
+	}
+
+	var c, s, m interface{}
+	if err := json.Unmarshal(current, &c); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(sent, &s); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(modified, &m); err != nil {
+		return nil, err
+	}
+
+	restored, err := json.Marshal(restoreStripped(c, s, m))
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := CreatePatch(current, restored)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonpatch.DecodePatch(raw)
+}
+
+// restoreStripped puts the fields stripped from current to get sent
+// back into modified, the endpoint's version of sent, and returns it.
+// Object members are matched by key, list elements by their name when
+// they have one, otherwise by index. A stripped member is restored
+// when the endpoint kept the object holding it and did not set the
+// member itself, a masked list element when the endpoint left the
+// placeholder.
+func restoreStripped(current interface{}, sent interface{}, modified interface{}) interface{} {
+	switch m := modified.(type) {
+	case map[string]interface{}:
+		c, cok := current.(map[string]interface{})
+		s, sok := sent.(map[string]interface{})
+		if !cok || !sok {
+			return modified
+		}
+
+		for k, cv := range c {
+			sv, inSent := s[k]
+			mv, inModified := m[k]
+			switch {
+			case !inSent && !inModified:
+				m[k] = cv
+			case inSent && inModified:
+				m[k] = restoreStripped(cv, sv, mv)
+			}
+		}
+	case []interface{}:
+		c, cok := current.([]interface{})
+		s, sok := sent.([]interface{})
+		if !cok || !sok || len(c) != len(s) {
+			return modified
+		}
+
+		for j, mv := range m {
+			if i := matchElement(s, mv, j); i >= 0 {
+				m[j] = restoreStripped(c[i], s[i], mv)
+			}
+		}
+	case string:
+		if m == redactedValue && sent == redactedValue {
+			return current
+		}
+	}
+
+	return modified
+}
+
+// matchElement returns the index of the element of list matching elem
+// at index j of the endpoint's version of list, -1 when there is none.
+// Elements with a name only match the element of the same name.
+func matchElement(list []interface{}, elem interface{}, j int) int {
+	if name, ok := elementName(elem); ok {
+		for i, e := range list {
+			if n, ok := elementName(e); ok && n == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if j < len(list) {
+		if _, ok := elementName(list[j]); !ok {
+			return j
+		}
+	}
+
+	return -1
+}
+
+// elementName returns the name of a list element such as a container
+// or environment variable.
+func elementName(elem interface{}) (string, bool) {
+	m, ok := elem.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+
+	name, ok := m["name"].(string)
+	return name, ok
+}
@@ -0,0 +1,351 @@
+package amp
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+const redactionPod = `{
+	"metadata": {
+		"name": "app",
+		"annotations": {"kubectl.kubernetes.io/last-applied-configuration": "{}", "team": "a"},
+		"managedFields": [{"manager": "kubectl"}]
+	},
+	"spec": {
+		"containers": [{
+			"name": "app",
+			"image": "app:1",
+			"args": ["--token", "secret"],
+			"env": [
+				{"name": "DB_PASSWORD", "value": "hunter2"},
+				{"name": "API_TOKEN", "valueFrom": {"secretKeyRef": {"name": "api", "key": "token"}}},
+				{"name": "MODE", "value": "prod"}
+			]
+		}]
+	},
+	"status": {"phase": "Pending"}
+}`
+
+var testRedaction = RedactionPolicy{
+	Paths: []string{
+		"/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration",
+		"/spec/containers/*/args/1",
+	},
+	EnvNames: []string{"*password*", "*_TOKEN"},
+}
+
+func decodeJSON(t *testing.T, raw string) interface{} {
+	t.Helper()
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatalf("unable to decode %s: %v", raw, err)
+	}
+
+	return v
+}
+
+// valueAt returns the value at pointer in the JSON document raw.
+func valueAt(t *testing.T, raw []byte, pointer string) interface{} {
+	t.Helper()
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatalf("unable to decode %s: %v", raw, err)
+	}
+
+	for _, token := range pointerTokens(pointer) {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			v = c[token]
+		case []interface{}:
+			i := 0
+			if err := json.Unmarshal([]byte(token), &i); err != nil || i >= len(c) {
+				return nil
+			}
+			v = c[i]
+		default:
+			return nil
+		}
+	}
+
+	return v
+}
+
+func TestRedactionPolicyRedact(t *testing.T) {
+	tests := []struct {
+		pointer string
+		masked  interface{}
+		removed interface{}
+	}{
+		{pointer: "/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration", masked: redactedValue, removed: nil},
+		{pointer: "/metadata/annotations/team", masked: "a", removed: "a"},
+		{pointer: "/spec/containers/0/args/0", masked: "--token", removed: "--token"},
+		{pointer: "/spec/containers/0/args/1", masked: redactedValue, removed: redactedValue},
+		{pointer: "/spec/containers/0/env/0/value", masked: redactedValue, removed: nil},
+		{pointer: "/spec/containers/0/env/1/valueFrom/secretKeyRef/name", masked: "api", removed: "api"},
+		{pointer: "/spec/containers/0/env/2/value", masked: "prod", removed: "prod"},
+	}
+
+	for _, remove := range []bool{false, true} {
+		doc := decodeJSON(t, redactionPod)
+		testRedaction.redact(doc, remove)
+
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			want := tt.masked
+			if remove {
+				want = tt.removed
+			}
+			if got := valueAt(t, raw, tt.pointer); got != want {
+				t.Errorf("redact(remove %v) %s = %v, want %v", remove, tt.pointer, got, want)
+			}
+		}
+	}
+}
+
+func TestRedactionPolicyZeroValue(t *testing.T) {
+	var rp RedactionPolicy
+
+	if rp.enabled() {
+		t.Error("zero RedactionPolicy is enabled")
+	}
+	if got := rp.redactReview([]byte(redactionPod)); string(got) != redactionPod {
+		t.Errorf("zero RedactionPolicy changed the review: %s", got)
+	}
+}
+
+func TestRedactionPolicyRedactPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		pointer string
+		want    interface{}
+	}{
+		{
+			name:    "path",
+			patch:   `[{"op":"add","path":"/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration","value":"{}"}]`,
+			pointer: "/0/value",
+			want:    redactedValue,
+		},
+		{
+			name:    "below a path",
+			patch:   `[{"op":"add","path":"/spec/containers/0","value":{"name":"c","args":["a","b"]}}]`,
+			pointer: "/0/value/args/1",
+			want:    redactedValue,
+		},
+		{
+			name:    "env value",
+			patch:   `[{"op":"replace","path":"/spec/containers/0/env/3/value","value":"anything"}]`,
+			pointer: "/0/value",
+			want:    redactedValue,
+		},
+		{
+			name:    "env var",
+			patch:   `[{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"SESSION_TOKEN","value":"t"}}]`,
+			pointer: "/0/value/value",
+			want:    redactedValue,
+		},
+		{
+			name:    "env list",
+			patch:   `[{"op":"add","path":"/spec/containers/0/env","value":[{"name":"DB_PASSWORD","value":"p"},{"name":"MODE","value":"dev"}]}]`,
+			pointer: "/0/value/1/value",
+			want:    "dev",
+		},
+		{
+			name:    "unrelated",
+			patch:   `[{"op":"replace","path":"/spec/containers/0/image","value":"app:2"}]`,
+			pointer: "/0/value",
+			want:    "app:2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redacted := testRedaction.redactPatch([]byte(tt.patch))
+			if redacted == nil {
+				t.Fatalf("redactPatch(%s) = nil", tt.patch)
+			}
+			if got := valueAt(t, redacted, tt.pointer); got != tt.want {
+				t.Errorf("redactPatch(%s) %s = %v, want %v", tt.patch, tt.pointer, got, tt.want)
+			}
+		})
+	}
+
+	if got := testRedaction.redactPatch([]byte(`{"op":"add"}`)); got != nil {
+		t.Errorf("redactPatch() of an invalid patch = %s, want nil", got)
+	}
+}
+
+func TestRedactionPolicyRedactMetadata(t *testing.T) {
+	annotations := map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}", "team": "a"}
+
+	got := testRedaction.redactMetadata("annotations", annotations)
+	if got["kubectl.kubernetes.io/last-applied-configuration"] != redactedValue || got["team"] != "a" {
+		t.Errorf("redactMetadata() = %v", got)
+	}
+	if annotations["kubectl.kubernetes.io/last-applied-configuration"] != "{}" {
+		t.Error("redactMetadata() changed the annotations it was given")
+	}
+}
+
+func TestRedactionPolicyMinimalObject(t *testing.T) {
+	minimal, err := testRedaction.minimalObject([]byte(redactionPod))
+	if err != nil {
+		t.Fatalf("minimalObject() error = %v", err)
+	}
+
+	for pointer, want := range map[string]interface{}{
+		"/metadata/managedFields":        nil,
+		"/status":                        nil,
+		"/spec/containers/0/env/0/value": nil,
+		"/spec/containers/0/args/1":      redactedValue,
+		"/spec/containers/0/image":       "app:1",
+		"/metadata/annotations/team":     "a",
+	} {
+		if got := valueAt(t, minimal, pointer); got != want {
+			t.Errorf("minimalObject() %s = %v, want %v", pointer, got, want)
+		}
+	}
+}
+
+// TestRestorePatch applies the response of a PayloadMinimal endpoint
+// in every format and checks the fields stripped from the object sent
+// are kept.
+func TestRestorePatch(t *testing.T) {
+	current := []byte(redactionPod)
+
+	sent, err := testRedaction.minimalObject(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := map[string]interface{}{
+		"name":  "proxy",
+		"image": "proxy:1",
+		"env":   []interface{}{map[string]interface{}{"name": "DB_PASSWORD", "valueFrom": map[string]interface{}{"secretKeyRef": map[string]interface{}{"name": "proxy", "key": "password"}}}},
+	}
+
+	// the object sent with the image changed and a sidecar in front
+	var obj map[string]interface{}
+	if err := json.Unmarshal(sent, &obj); err != nil {
+		t.Fatal(err)
+	}
+	spec := obj["spec"].(map[string]interface{})
+	containers := spec["containers"].([]interface{})
+	containers[0].(map[string]interface{})["image"] = "app:2"
+	spec["containers"] = append([]interface{}{sidecar}, containers...)
+	object, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mergePatch, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"containers": spec["containers"]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		format ResponseFormat
+		body   string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "jsonpatch",
+			format: ResponseJSONPatch,
+			body:   `[{"op":"replace","path":"/spec/containers/0/image","value":"app:2"}]`,
+			want: map[string]interface{}{
+				"/spec/containers/0/image":          "app:2",
+				"/spec/containers/0/env/0/value":    "hunter2",
+				"/spec/containers/0/args/1":         "secret",
+				"/metadata/managedFields/0/manager": "kubectl",
+				"/status/phase":                     "Pending",
+			},
+		},
+		{
+			name:   "jsonpatch replacing the env",
+			format: ResponseJSONPatch,
+			body:   `[{"op":"replace","path":"/spec/containers/0/env","value":[{"name":"MODE","value":"dev"}]}]`,
+			want: map[string]interface{}{
+				"/spec/containers/0/env/0/name":  "MODE",
+				"/spec/containers/0/env/0/value": "dev",
+				"/spec/containers/0/env/1":       nil,
+			},
+		},
+		{
+			name:   "mergepatch",
+			format: ResponseMergePatch,
+			body:   string(mergePatch),
+			want: map[string]interface{}{
+				"/spec/containers/0/name":                              "proxy",
+				"/spec/containers/0/env/0/value":                       nil,
+				"/spec/containers/0/env/0/valueFrom/secretKeyRef/name": "proxy",
+				"/spec/containers/1/image":                             "app:2",
+				"/spec/containers/1/env/0/value":                       "hunter2",
+				"/spec/containers/1/args/1":                            "secret",
+				"/metadata/managedFields/0/manager":                    "kubectl",
+			},
+		},
+		{
+			name:   "object",
+			format: ResponseObject,
+			body:   string(object),
+			want: map[string]interface{}{
+				"/spec/containers/0/env/0/value":                                          nil,
+				"/spec/containers/1/image":                                                "app:2",
+				"/spec/containers/1/env/0/value":                                          "hunter2",
+				"/spec/containers/1/env/2/value":                                          "prod",
+				"/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration": "{}",
+				"/status/phase":                                                           "Pending",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := toJSONPatch(tt.format, sent, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("toJSONPatch() error = %v", err)
+			}
+
+			patch, err := jsonpatch.DecodePatch(raw)
+			if err != nil {
+				t.Fatalf("unable to decode patch %s: %v", raw, err)
+			}
+
+			restored, err := restorePatch(current, sent, patch)
+			if err != nil {
+				t.Fatalf("restorePatch() error = %v", err)
+			}
+
+			patched, err := restored.Apply(current)
+			if err != nil {
+				t.Fatalf("unable to apply restored patch: %v", err)
+			}
+
+			for pointer, want := range tt.want {
+				if got := valueAt(t, patched, pointer); got != want {
+					t.Errorf("%s = %v, want %v in %s", pointer, got, want, patched)
+				}
+			}
+		})
+	}
+}
+
+func TestRestorePatchInvalid(t *testing.T) {
+	patch, err := jsonpatch.DecodePatch([]byte(`[{"op":"remove","path":"/spec/missing"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := restorePatch([]byte(`{"spec":{}}`), []byte(`{"spec":{}}`), patch); err == nil {
+		t.Error("restorePatch() of a patch that does not apply to the object sent expected an error")
+	}
+}
@@ -0,0 +1,238 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Endpoint is an HTTP endpoint an admission request is forwarded to.
+type Endpoint struct {
+	// URL receives the admission object as a JSON POST.
+	URL string
+
+	// Service is the Kubernetes Service the endpoint was given as, if
+	// any, URL is then its HTTPS URL.
+	Service *ServiceReference
+
+	// Header is added to the outbound request.
+	Header http.Header
+
+	// Format selects the payload POSTed to the endpoint, defaults to
+	// PayloadLegacy.
+	Format PayloadFormat
+
+	// Payload selects how much of the object is sent, defaults to
+	// PayloadFull.
+	Payload PayloadProjection
+
+	// Response selects the body a mutation endpoint returns, when empty
+	// it is taken from the response Content-Type.
+	Response ResponseFormat
+
+	// Timeout bounds each attempt to call the endpoint, when zero the
+	// namespace or configured endpoint timeout applies.
+	Timeout time.Duration
+
+	// client makes the call when set, otherwise Api.HttpClient.
+	client *http.Client
+
+	// signer signs the call when set.
+	signer *signer
+
+	// audience requests a bearer token for the call from a
+	// TokenTransport when set.
+	audience string
+
+	// addrs are the Service endpoint addresses a ServiceDialContext
+	// connects to instead of the Service when set.
+	addrs []string
+
+	// Source describes where the endpoint was resolved from and is
+	// used in logs.
+	Source string
+}
+
+// EndpointResolver resolves the endpoints an admission request is
+// forwarded to. obj is the decoded object under review. Returning no
+// endpoints applies the default for the review type, mutation makes
+// no changes and validation allows.
+type EndpointResolver interface {
+	Resolve(ctx context.Context, review AdmissionReview, req *admissionv1.AdmissionRequest, obj runtime.Object) ([]Endpoint, error)
+}
+
+// EndpointResolverFunc adapts a function to an EndpointResolver.
+type EndpointResolverFunc func(ctx context.Context, review AdmissionReview, req *admissionv1.AdmissionRequest, obj runtime.Object) ([]Endpoint, error)
+
+// Resolve calls f.
+func (f EndpointResolverFunc) Resolve(ctx context.Context, review AdmissionReview, req *admissionv1.AdmissionRequest, obj runtime.Object) ([]Endpoint, error) {
+	return f(ctx, review, req, obj)
+}
+
+// NamespaceGetter gets a Namespace by name, Api implements it with an
+// informer cache.
+type NamespaceGetter interface {
+	GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+}
+
+// NamespaceAnnotationResolver is the default EndpointResolver, it reads
+// the endpoint from an annotation on the request's Namespace, see
+// ResourceAnnotation for the annotation used by each resource.
+//
+// When PodOverride is set the same annotation on the object under
+// review selects the endpoint instead, provided the endpoint host
+// matches one of the comma separated patterns (see path.Match) in the
+// Namespace's AllowedHostsAnnotation. Namespaces without the
+// allowlist do not permit overrides.
+type NamespaceAnnotationResolver struct {
+	Namespaces             NamespaceGetter
+	MutationEpAnnotation   string
+	ValidationEpAnnotation string
+	PodOverride            bool
+	AllowedHostsAnnotation string
+}
+
+// Resolve looks up the annotation for the review type on the object
+// when overrides are enabled, then on the request's Namespace.
+// Requests for cluster scoped resources have no Namespace and resolve
+// no endpoints.
+func (r *NamespaceAnnotationResolver) Resolve(ctx context.Context, review AdmissionReview, req *admissionv1.AdmissionRequest, obj runtime.Object) ([]Endpoint, error) {
+	if req.Namespace == "" {
+		return nil, nil
+	}
+
+	ns, err := r.Namespaces.GetNamespace(ctx, req.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get namespace %s: %w", req.Namespace, err)
+	}
+
+	annotation := ResourceAnnotation(r.annotation(review), req.Resource, req.SubResource)
+
+	if r.PodOverride && obj != nil {
+		eps, err := r.override(ns, obj, annotation)
+		if err != nil {
+			return nil, err
+		}
+		if eps != nil {
+			return eps, nil
+		}
+	}
+
+	value, ok := ns.GetAnnotations()[annotation]
+	if !ok {
+		return nil, nil
+	}
+
+	eps, err := ParseEndpoints(value)
+	if err != nil {
+		return nil, fmt.Errorf("namespace %s annotation %s: %w", req.Namespace, annotation, err)
+	}
+
+	for i := range eps {
+		eps[i].Source = "namespace/" + req.Namespace + ":" + annotation
+	}
+
+	return eps, nil
+}
+
+// override returns the endpoints annotated on obj, if any, after
+// checking their hosts against the Namespace allowlist.
+func (r *NamespaceAnnotationResolver) override(ns *corev1.Namespace, obj runtime.Object, annotation string) ([]Endpoint, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, nil
+	}
+
+	eps, err := ParseEndpoints(accessor.GetAnnotations()[annotation])
+	if err != nil {
+		return nil, fmt.Errorf("endpoint override %s on %s: %w", annotation, accessor.GetName(), err)
+	}
+
+	if len(eps) == 0 {
+		return nil, nil
+	}
+
+	allowed, ok := ns.GetAnnotations()[r.AllowedHostsAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("endpoint override %s on %s is not permitted, namespace %s has no %s annotation",
+			annotation, accessor.GetName(), ns.Name, r.AllowedHostsAnnotation)
+	}
+
+	for i, ep := range eps {
+		u, err := url.Parse(ep.URL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse endpoint override %s on %s: %w", annotation, accessor.GetName(), err)
+		}
+
+		if !hostAllowed(u.Hostname(), allowed) {
+			return nil, fmt.Errorf("endpoint override host %s on %s is not allowed by namespace %s",
+				u.Hostname(), accessor.GetName(), ns.Name)
+		}
+
+		eps[i].Source = "object/" + ns.Name + "/" + accessor.GetName() + ":" + annotation
+	}
+
+	return eps, nil
+}
+
+func (r *NamespaceAnnotationResolver) annotation(review AdmissionReview) string {
+	if review == AdmissionReviewValidate {
+		return r.ValidationEpAnnotation
+	}
+
+	return r.MutationEpAnnotation
+}
+
+// ResourceAnnotation returns the endpoint annotation for a resource
+// and subresource. Pods use base unchanged, any other resource appends
+// its resource and group, e.g. mutation.amp.txn2.com/ep.deployments.apps
+// or validation.amp.txn2.com/ep.configmaps. A subresource is appended
+// to the resource with an underscore, which resource names can not
+// contain, e.g. validation.amp.txn2.com/ep.pods_exec or
+// mutation.amp.txn2.com/ep.deployments_scale.apps, so requests for a
+// subresource are never sent to the endpoints of its resource.
+func ResourceAnnotation(base string, gvr metav1.GroupVersionResource, subResource string) string {
+	if gvr.Group == "" && gvr.Resource == "pods" && subResource == "" {
+		return base
+	}
+
+	annotation := base + "." + gvr.Resource
+	if subResource != "" {
+		annotation += "_" + subResource
+	}
+	if gvr.Group != "" {
+		annotation += "." + gvr.Group
+	}
+
+	return annotation
+}
+
+// hostAllowed reports whether host matches one of the comma separated
+// patterns.
+func hostAllowed(host string, patterns string) bool {
+	if host == "" {
+		return false
+	}
+
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
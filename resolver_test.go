@@ -0,0 +1,84 @@
+package amp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResourceAnnotation(t *testing.T) {
+	const base = "mutation.amp.txn2.com/ep"
+
+	tests := []struct {
+		gvr         metav1.GroupVersionResource
+		subResource string
+		want        string
+	}{
+		{gvr: metav1.GroupVersionResource{Version: "v1", Resource: "pods"}, want: base},
+		{gvr: metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"}, want: base + ".configmaps"},
+		{gvr: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, want: base + ".deployments.apps"},
+		{gvr: metav1.GroupVersionResource{Version: "v1", Resource: "pods"}, subResource: "status", want: base + ".pods_status"},
+		{gvr: metav1.GroupVersionResource{Version: "v1", Resource: "pods"}, subResource: "exec", want: base + ".pods_exec"},
+		{gvr: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, subResource: "scale", want: base + ".deployments_scale.apps"},
+	}
+
+	for _, tt := range tests {
+		if got := ResourceAnnotation(base, tt.gvr, tt.subResource); got != tt.want {
+			t.Errorf("ResourceAnnotation(%v, %q) = %q, want %q", tt.gvr, tt.subResource, got, tt.want)
+		}
+	}
+}
+
+// namespaceGetterFunc adapts a function to a NamespaceGetter.
+type namespaceGetterFunc func(ctx context.Context, name string) (*corev1.Namespace, error)
+
+func (f namespaceGetterFunc) GetNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return f(ctx, name)
+}
+
+func TestNamespaceAnnotationResolverResolve(t *testing.T) {
+	const annotation = "validation.amp.txn2.com/ep"
+
+	r := &NamespaceAnnotationResolver{
+		Namespaces: namespaceGetterFunc(func(ctx context.Context, name string) (*corev1.Namespace, error) {
+			switch name {
+			case "":
+				return nil, errors.New("resource name may not be empty")
+			case "team-a":
+				return testNamespace(name, map[string]string{annotation + ".namespaces": "http://ns.team-a:8080/validate"}), nil
+			}
+			return nil, errors.New("not found")
+		}),
+		MutationEpAnnotation:   "mutation.amp.txn2.com/ep",
+		ValidationEpAnnotation: annotation,
+	}
+
+	namespaces := metav1.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+	tests := []struct {
+		namespace string
+		want      int
+		wantErr   bool
+	}{
+		{namespace: "", want: 0},
+		{namespace: "team-a", want: 1},
+		{namespace: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		req := &admissionv1.AdmissionRequest{Namespace: tt.namespace, Resource: namespaces}
+
+		eps, err := r.Resolve(context.Background(), AdmissionReviewValidate, req, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Resolve(%q) error = %v, wantErr %v", tt.namespace, err, tt.wantErr)
+			continue
+		}
+		if len(eps) != tt.want {
+			t.Errorf("Resolve(%q) = %d endpoints, want %d", tt.namespace, len(eps), tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package amp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultWebhookTimeout matches the timeoutSeconds of the webhook
+// configurations in k8s/80-webhook.yml and the Kubernetes default.
+const defaultWebhookTimeout = 10 * time.Second
+
+// webhookDeadlineMargin is reserved from the webhook timeout to
+// encode and return the response before the API server gives up.
+const webhookDeadlineMargin = 500 * time.Millisecond
+
+// errWebhookDeadline is the cause of an admission request context
+// that reached its deadline before the API server gave up.
+var errWebhookDeadline = errors.New("webhook deadline exceeded")
+
+// RetryPolicy retries endpoint calls that failed to reach the
+// endpoint or returned one of StatusCodes. Retries never extend past
+// the deadline of the admission request.
+type RetryPolicy struct {
+	// Max is the number of retries after the first attempt, zero
+	// disables retries.
+	Max int
+
+	// Backoff is the delay before the first retry, doubled for every
+	// further retry up to MaxBackoff when set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// StatusCodes are the endpoint response codes that are retried.
+	StatusCodes []int
+}
+
+// ParseStatusCodes parses a comma separated list of HTTP status codes.
+func ParseStatusCodes(value string) ([]int, error) {
+	var codes []int
+	for _, code := range strings.Split(value, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code %q", code)
+		}
+		codes = append(codes, n)
+	}
+
+	return codes, nil
+}
+
+// retryable reports whether the failed call err should be retried.
+func (rp RetryPolicy) retryable(err error) bool {
+	var epErr *EndpointError
+	if !errors.As(err, &epErr) {
+		return false
+	}
+
+	switch epErr.Class {
+	case FailureTransport:
+		return true
+	case FailureStatus:
+		for _, code := range rp.StatusCodes {
+			if code == epErr.StatusCode {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// backoff returns the delay before retry number attempt, starting at
+// zero.
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	delay := rp.Backoff
+	for i := 0; i < attempt; i++ {
+		delay *= 2
+		if rp.MaxBackoff > 0 && delay >= rp.MaxBackoff {
+			return rp.MaxBackoff
+		}
+	}
+
+	if rp.MaxBackoff > 0 && delay > rp.MaxBackoff {
+		return rp.MaxBackoff
+	}
+
+	return delay
+}
+
+// webhookTimeout returns the timeout the API server applies to the
+// webhook call r. The API server sends it as the timeout query
+// parameter, a.WebhookTimeout is used when it is missing.
+func (a *Api) webhookTimeout(r *http.Request) time.Duration {
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		a.Log.Warn("ignoring invalid webhook timeout parameter",
+			zap.String("timeout", value),
+		)
+	}
+
+	return a.WebhookTimeout
+}
+
+// requestDeadline returns the deadline endpoint calls for a webhook
+// call with timeout must finish by.
+func requestDeadline(start time.Time, timeout time.Duration) time.Time {
+	margin := webhookDeadlineMargin
+	if timeout <= 2*margin {
+		margin = timeout / 4
+	}
+
+	return start.Add(timeout - margin)
+}
+
+// endpointTimeout returns the per attempt endpoint timeout annotated
+// on the namespace, or the configured default.
+func (a *Api) endpointTimeout(ctx context.Context, namespace string, logInfo []zap.Field) time.Duration {
+	if namespace == "" {
+		return a.EndpointTimeout
+	}
+
+	ns, err := a.GetNamespace(ctx, namespace)
+	if err != nil {
+		return a.EndpointTimeout
+	}
+
+	value, ok := ns.GetAnnotations()[a.EndpointTimeoutAnnotation]
+	if !ok {
+		return a.EndpointTimeout
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		a.Log.Warn("ignoring invalid endpoint timeout annotation",
+			append(logInfo, zap.String("timeout", value))...,
+		)
+		return a.EndpointTimeout
+	}
+
+	return timeout
+}
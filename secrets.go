@@ -0,0 +1,66 @@
+package amp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultSecretRefresh = time.Minute
+
+type cachedSecret struct {
+	secret  *corev1.Secret
+	checked time.Time
+}
+
+// secretCache caches the Secrets referenced by namespace annotations
+// keyed by namespace and Secret name.
+type secretCache struct {
+	mu sync.Mutex
+	m  map[string]*cachedSecret
+}
+
+// namespaceSecret returns the Secret in namespace named by the
+// namespace's annotation, nil when the namespace does not have the
+// annotation. Secrets are re-read after SecretRefresh. A namespace
+// that can not be looked up is an error, as it may ask for a Secret.
+func (a *Api) namespaceSecret(ctx context.Context, namespace string, annotation string) (*corev1.Secret, error) {
+	if namespace == "" {
+		return nil, nil
+	}
+
+	ns, err := a.GetNamespace(ctx, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get namespace %s for %s: %w", namespace, annotation, err)
+	}
+
+	name := ns.GetAnnotations()[annotation]
+	if name == "" {
+		return nil, nil
+	}
+
+	key := namespace + "/" + name
+
+	a.secrets.mu.Lock()
+	cached, ok := a.secrets.m[key]
+	a.secrets.mu.Unlock()
+
+	if ok && time.Since(cached.checked) < a.SecretRefresh {
+		return cached.secret, nil
+	}
+
+	secret, err := a.Cs.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get secret %s referenced by %s: %w", key, annotation, err)
+	}
+
+	a.secrets.mu.Lock()
+	a.secrets.m[key] = &cachedSecret{secret: secret, checked: time.Now()}
+	a.secrets.mu.Unlock()
+
+	return secret, nil
+}
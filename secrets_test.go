@@ -0,0 +1,118 @@
+package amp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// newTestApi returns an Api whose clientset talks to an API server
+// serving objects, keyed by request path, and 404 for anything else.
+func newTestApi(t *testing.T, objects map[string]interface{}) *Api {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		obj, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(srv.Close)
+
+	cs, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("unable to create clientset: %v", err)
+	}
+
+	return &Api{
+		Config: &Config{
+			Cs:                        cs,
+			Log:                       zap.NewNop(),
+			ClientTLSSecretAnnotation: defaultClientTLSSecretAnnotation,
+			SigningSecretAnnotation:   defaultSigningSecretAnnotation,
+			SecretRefresh:             time.Minute,
+		},
+		secrets:   secretCache{m: map[string]*cachedSecret{}},
+		nsClients: namespaceClients{m: map[string]*namespaceClient{}},
+	}
+}
+
+func testNamespace(name string, annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		TypeMeta:   metav1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+	}
+}
+
+func TestNamespaceSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "amp-signing", Namespace: "team-a"},
+		Data:       map[string][]byte{"signing-key": []byte("key")},
+	}
+
+	a := newTestApi(t, map[string]interface{}{
+		"/api/v1/namespaces/team-a":                     testNamespace("team-a", map[string]string{defaultSigningSecretAnnotation: "amp-signing"}),
+		"/api/v1/namespaces/team-a/secrets/amp-signing": secret,
+		"/api/v1/namespaces/team-b":                     testNamespace("team-b", nil),
+		"/api/v1/namespaces/team-c":                     testNamespace("team-c", map[string]string{defaultSigningSecretAnnotation: "missing"}),
+	})
+
+	tests := []struct {
+		namespace  string
+		wantSecret bool
+		wantErr    string
+	}{
+		{namespace: "team-a", wantSecret: true},
+		{namespace: "team-b"},
+		{namespace: ""},
+		{namespace: "team-c", wantErr: "unable to get secret team-c/missing"},
+		{namespace: "unknown", wantErr: "unable to get namespace unknown"},
+	}
+
+	for _, tt := range tests {
+		got, err := a.namespaceSecret(context.Background(), tt.namespace, defaultSigningSecretAnnotation)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("namespaceSecret(%q) error = %v, want %q", tt.namespace, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("namespaceSecret(%q) error = %v", tt.namespace, err)
+			continue
+		}
+		if (got != nil) != tt.wantSecret {
+			t.Errorf("namespaceSecret(%q) = %v, want a secret %v", tt.namespace, got, tt.wantSecret)
+		}
+	}
+}
+
+func TestEndpointClientNamespaceLookupFails(t *testing.T) {
+	a := newTestApi(t, nil)
+
+	if _, err := a.endpointClient(context.Background(), "unknown"); err == nil {
+		t.Error("endpointClient() of a namespace that can not be read fell back to the global client")
+	}
+}
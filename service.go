@@ -0,0 +1,194 @@
+package amp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// servicePrefix starts an endpoint referencing a Kubernetes Service.
+const servicePrefix = "service/"
+
+// defaultServicePort is the port of a ServiceReference without one,
+// as for the clientConfig.service of webhook configurations.
+const defaultServicePort = 443
+
+// ServiceReference is an endpoint given as a Kubernetes Service,
+// written as service/namespace/name:port/path in endpoint annotations.
+// It is called over HTTPS at name.namespace.svc.
+type ServiceReference struct {
+	Namespace string
+	Name      string
+	Port      int32
+	Path      string
+}
+
+// ParseServiceReference parses a service/namespace/name:port/path
+// endpoint. The port defaults to 443 and the path to /.
+func ParseServiceReference(value string) (*ServiceReference, error) {
+	if !strings.HasPrefix(value, servicePrefix) {
+		return nil, fmt.Errorf("service reference %q must start with %s", value, servicePrefix)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, servicePrefix), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("service reference %q must be %snamespace/name:port/path", value, servicePrefix)
+	}
+
+	ref := &ServiceReference{
+		Namespace: parts[0],
+		Name:      parts[1],
+		Port:      defaultServicePort,
+		Path:      "/",
+	}
+
+	if len(parts) == 3 {
+		ref.Path += parts[2]
+	}
+
+	if i := strings.LastIndex(ref.Name, ":"); i >= 0 {
+		port, err := strconv.ParseInt(ref.Name[i+1:], 10, 32)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("service reference %q has an invalid port", value)
+		}
+		ref.Name, ref.Port = ref.Name[:i], int32(port)
+	}
+
+	return ref, nil
+}
+
+// Host returns the cluster DNS name and port of the Service.
+func (ref *ServiceReference) Host() string {
+	return net.JoinHostPort(ref.Name+"."+ref.Namespace+".svc", strconv.Itoa(int(ref.Port)))
+}
+
+// URL returns the HTTPS URL of the Service.
+func (ref *ServiceReference) URL() string {
+	return "https://" + ref.Host() + ref.Path
+}
+
+// String returns the reference as written in endpoint annotations.
+func (ref *ServiceReference) String() string {
+	return servicePrefix + ref.Namespace + "/" + ref.Name + ":" + strconv.Itoa(int(ref.Port)) + ref.Path
+}
+
+// serviceAddresses returns the addresses of the ready endpoints of the
+// Service referenced by ref from its EndpointSlices.
+func (a *Api) serviceAddresses(ref *ServiceReference) ([]string, error) {
+	svc, err := a.svcLister.Services(ref.Namespace).Get(ref.Name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get service %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+
+	var portName string
+	found := false
+	for _, p := range svc.Spec.Ports {
+		if p.Port == ref.Port && (p.Protocol == "" || p.Protocol == corev1.ProtocolTCP) {
+			portName, found = p.Name, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("service %s/%s has no TCP port %d", ref.Namespace, ref.Name, ref.Port)
+	}
+
+	slices, err := a.sliceLister.EndpointSlices(ref.Namespace).List(labels.SelectorFromSet(labels.Set{
+		discoveryv1beta1.LabelServiceName: ref.Name,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list endpoint slices of service %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+
+	var addrs []string
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1beta1.AddressTypeIPv4 && slice.AddressType != discoveryv1beta1.AddressTypeIPv6 {
+			continue
+		}
+
+		port := slicePort(slice, portName)
+		if port == 0 {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(int(port))))
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("service %s/%s has no ready endpoints", ref.Namespace, ref.Name)
+	}
+
+	return addrs, nil
+}
+
+// slicePort returns the port named name of slice, zero when it has
+// none.
+func slicePort(slice *discoveryv1beta1.EndpointSlice, name string) int32 {
+	for _, p := range slice.Ports {
+		pName := ""
+		if p.Name != nil {
+			pName = *p.Name
+		}
+		if pName == name && p.Port != nil {
+			return *p.Port
+		}
+	}
+
+	return 0
+}
+
+type dialAddressesKey struct{}
+
+// dialAddresses are the addresses to connect to instead of host.
+type dialAddresses struct {
+	host  string
+	addrs []string
+}
+
+// withDialAddresses returns a context connecting to addrs instead of
+// host with a ServiceDialContext.
+func withDialAddresses(ctx context.Context, host string, addrs []string) context.Context {
+	return context.WithValue(ctx, dialAddressesKey{}, dialAddresses{host: host, addrs: addrs})
+}
+
+// ServiceDialContext wraps dial so Service endpoints resolved through
+// EndpointSlices connect straight to a ready endpoint of the Service.
+// The request keeps the Service host, so TLS verifies the Service
+// certificate. Other connections are dialed unchanged.
+func ServiceDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		da, ok := ctx.Value(dialAddressesKey{}).(dialAddresses)
+		if !ok || da.host != address || len(da.addrs) == 0 {
+			return dial(ctx, network, address)
+		}
+
+		var errs []error
+		start := rand.Intn(len(da.addrs))
+		for i := range da.addrs {
+			conn, err := dial(ctx, network, da.addrs[(start+i)%len(da.addrs)])
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,217 @@
+package amp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// Headers of signed endpoint requests. The signature is an HMAC-SHA256
+// over the timestamp, nonce, request UID and body, see Sign.
+const (
+	SignatureHeader  = "X-Amp-Signature"
+	TimestampHeader  = "X-Amp-Timestamp"
+	NonceHeader      = "X-Amp-Nonce"
+	RequestUIDHeader = "X-Amp-Request-Uid"
+)
+
+// SigningKeySecretKey is the key of the signing key in the Secret a
+// namespace references with the signing secret annotation.
+const SigningKeySecretKey = "signing-key"
+
+const (
+	signatureVersion       = "v1"
+	defaultSignatureMaxAge = 5 * time.Minute
+)
+
+var (
+	ErrSignatureMissing = errors.New("request is not signed")
+	ErrSignatureInvalid = errors.New("request signature is invalid")
+	ErrSignatureExpired = errors.New("request signature timestamp is outside the allowed window")
+	ErrSignatureReplay  = errors.New("request nonce was already used")
+)
+
+// Sign returns the SignatureHeader value for an endpoint request body
+// signed with key:
+//
+//	v1=hex(HMAC-SHA256(key, timestamp + "." + nonce + "." + uid + "." + body))
+func Sign(key []byte, timestamp string, nonce string, uid string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "." + nonce + "." + uid + "."))
+	mac.Write(body)
+
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signer signs the requests to an endpoint for the admission request
+// with uid.
+type signer struct {
+	key []byte
+	uid string
+}
+
+// sign adds the signature headers to req for body. Every attempt gets
+// its own timestamp and nonce.
+func (s *signer) sign(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonceHex)
+	req.Header.Set(RequestUIDHeader, s.uid)
+	req.Header.Set(SignatureHeader, Sign(s.key, timestamp, nonceHex, s.uid, body))
+
+	return nil
+}
+
+// endpointSigner returns the signer for the endpoint calls of req, nil
+// when its namespace does not reference a signing Secret with
+// SigningSecretAnnotation.
+func (a *Api) endpointSigner(ctx context.Context, req *admissionv1.AdmissionRequest) (*signer, error) {
+	secret, err := a.namespaceSecret(ctx, req.Namespace, a.SigningSecretAnnotation)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	key := secret.Data[SigningKeySecretKey]
+	if len(key) == 0 {
+		return nil, fmt.Errorf("signing secret %s/%s has no %s", req.Namespace, secret.Name, SigningKeySecretKey)
+	}
+
+	return &signer{key: key, uid: string(req.UID)}, nil
+}
+
+// SignatureVerifier verifies requests signed by amp for endpoints
+// written in Go. Requests must be signed with Key, carry a timestamp
+// no further than MaxAge, five minutes when zero, from now and a nonce
+// that was not used before.
+//
+//	verifier := amp.NewSignatureVerifier(key)
+//
+//	func mutate(w http.ResponseWriter, r *http.Request) {
+//		if err := verifier.Verify(r); err != nil {
+//			http.Error(w, err.Error(), http.StatusUnauthorized)
+//			return
+//		}
+//		// ...
+//	}
+type SignatureVerifier struct {
+	Key    []byte
+	MaxAge time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewSignatureVerifier returns a SignatureVerifier for key accepting
+// timestamps up to five minutes old.
+func NewSignatureVerifier(key []byte) *SignatureVerifier {
+	return &SignatureVerifier{
+		Key:    key,
+		MaxAge: defaultSignatureMaxAge,
+	}
+}
+
+// Verify verifies the signature of r. The body is read and replaced so
+// it can be read again by the handler.
+func (v *SignatureVerifier) Verify(r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return v.VerifySignature(r.Header, body)
+}
+
+// VerifySignature verifies the signature headers of a request with
+// body.
+func (v *SignatureVerifier) VerifySignature(header http.Header, body []byte) error {
+	signature := header.Get(SignatureHeader)
+	timestamp := header.Get(TimestampHeader)
+	nonce := header.Get(NonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return ErrSignatureMissing
+	}
+
+	if !strings.HasPrefix(signature, signatureVersion+"=") {
+		return ErrSignatureInvalid
+	}
+
+	expected := Sign(v.Key, timestamp, nonce, header.Get(RequestUIDHeader), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrSignatureInvalid
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	maxAge := v.maxAge()
+
+	signed := time.Unix(unix, 0)
+	now := time.Now()
+	if now.Sub(signed) > maxAge || signed.Sub(now) > maxAge {
+		return ErrSignatureExpired
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.sweep(now, maxAge)
+
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrSignatureReplay
+	}
+	v.nonces[nonce] = signed.Add(maxAge)
+
+	return nil
+}
+
+func (v *SignatureVerifier) maxAge() time.Duration {
+	if v.MaxAge <= 0 {
+		return defaultSignatureMaxAge
+	}
+
+	return v.MaxAge
+}
+
+// sweep forgets nonces whose timestamps are no longer accepted
+// anyway. v.mu must be held.
+func (v *SignatureVerifier) sweep(now time.Time, maxAge time.Duration) {
+	if v.nonces == nil {
+		v.nonces = map[string]time.Time{}
+	}
+
+	if now.Sub(v.lastSweep) < maxAge/2 {
+		return
+	}
+	v.lastSweep = now
+
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+}
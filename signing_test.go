@@ -0,0 +1,239 @@
+package amp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// signedHeader returns the headers of a request signed with key at
+// timestamp.
+func signedHeader(key []byte, timestamp time.Time, nonce string, uid string, body []byte) http.Header {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+
+	header := http.Header{}
+	header.Set(TimestampHeader, ts)
+	header.Set(NonceHeader, nonce)
+	header.Set(RequestUIDHeader, uid)
+	header.Set(SignatureHeader, Sign(key, ts, nonce, uid, body))
+
+	return header
+}
+
+func TestVerifySignature(t *testing.T) {
+	key := []byte("signing key")
+	body := []byte(`{"kind":"Pod"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		header func() http.Header
+		body   []byte
+		want   error
+	}{
+		{
+			name:   "valid",
+			header: func() http.Header { return signedHeader(key, now, "n1", "uid", body) },
+		},
+		{
+			name:   "within max age",
+			header: func() http.Header { return signedHeader(key, now.Add(-4*time.Minute), "n2", "uid", body) },
+		},
+		{
+			name:   "unsigned",
+			header: func() http.Header { return http.Header{} },
+			want:   ErrSignatureMissing,
+		},
+		{
+			name: "missing nonce",
+			header: func() http.Header {
+				h := signedHeader(key, now, "n3", "uid", body)
+				h.Del(NonceHeader)
+				return h
+			},
+			want: ErrSignatureMissing,
+		},
+		{
+			name:   "wrong key",
+			header: func() http.Header { return signedHeader([]byte("other key"), now, "n4", "uid", body) },
+			want:   ErrSignatureInvalid,
+		},
+		{
+			name:   "tampered body",
+			header: func() http.Header { return signedHeader(key, now, "n5", "uid", body) },
+			body:   []byte(`{"kind":"Secret"}`),
+			want:   ErrSignatureInvalid,
+		},
+		{
+			name: "tampered uid",
+			header: func() http.Header {
+				h := signedHeader(key, now, "n6", "uid", body)
+				h.Set(RequestUIDHeader, "other")
+				return h
+			},
+			want: ErrSignatureInvalid,
+		},
+		{
+			name: "tampered timestamp",
+			header: func() http.Header {
+				h := signedHeader(key, now.Add(-time.Hour), "n7", "uid", body)
+				h.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+				return h
+			},
+			want: ErrSignatureInvalid,
+		},
+		{
+			name: "unknown version",
+			header: func() http.Header {
+				h := signedHeader(key, now, "n8", "uid", body)
+				h.Set(SignatureHeader, "v2="+h.Get(SignatureHeader)[3:])
+				return h
+			},
+			want: ErrSignatureInvalid,
+		},
+		{
+			name:   "expired",
+			header: func() http.Header { return signedHeader(key, now.Add(-6*time.Minute), "n9", "uid", body) },
+			want:   ErrSignatureExpired,
+		},
+		{
+			name:   "future",
+			header: func() http.Header { return signedHeader(key, now.Add(6*time.Minute), "n10", "uid", body) },
+			want:   ErrSignatureExpired,
+		},
+		{
+			name:   "replayed",
+			header: func() http.Header { return signedHeader(key, now, "n1", "uid", body) },
+			want:   ErrSignatureReplay,
+		},
+	}
+
+	v := NewSignatureVerifier(key)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := body
+			if tt.body != nil {
+				b = tt.body
+			}
+
+			if err := v.VerifySignature(tt.header(), b); !errors.Is(err, tt.want) {
+				t.Errorf("VerifySignature() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifierZeroMaxAge(t *testing.T) {
+	key := []byte("signing key")
+	v := &SignatureVerifier{Key: key}
+
+	if err := v.VerifySignature(signedHeader(key, time.Now(), "n", "uid", nil), nil); err != nil {
+		t.Errorf("VerifySignature() without MaxAge error = %v", err)
+	}
+
+	if err := v.VerifySignature(signedHeader(key, time.Now().Add(-time.Hour), "m", "uid", nil), nil); !errors.Is(err, ErrSignatureExpired) {
+		t.Errorf("VerifySignature() of an hour old request without MaxAge error = %v, want %v", err, ErrSignatureExpired)
+	}
+}
+
+func TestSignatureVerifierSweep(t *testing.T) {
+	key := []byte("signing key")
+	v := &SignatureVerifier{Key: key, MaxAge: time.Minute}
+
+	if err := v.VerifySignature(signedHeader(key, time.Now(), "old", "uid", nil), nil); err != nil {
+		t.Fatalf("VerifySignature() error = %v", err)
+	}
+
+	v.nonces["old"] = time.Now().Add(-time.Second)
+	v.lastSweep = time.Now().Add(-time.Minute)
+
+	if err := v.VerifySignature(signedHeader(key, time.Now(), "new", "uid", nil), nil); err != nil {
+		t.Fatalf("VerifySignature() error = %v", err)
+	}
+
+	if _, ok := v.nonces["old"]; ok {
+		t.Error("expired nonce was not forgotten")
+	}
+	if _, ok := v.nonces["new"]; !ok {
+		t.Error("nonce was not remembered")
+	}
+}
+
+func TestSignerVerify(t *testing.T) {
+	key := []byte("signing key")
+	body := []byte(`{"kind":"Pod"}`)
+
+	s := &signer{key: key, uid: "uid"}
+	v := NewSignatureVerifier(key)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, "https://hooks.example.com/mutate", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.sign(req, body); err != nil {
+			t.Fatalf("sign() error = %v", err)
+		}
+
+		if err := v.Verify(req); err != nil {
+			t.Fatalf("Verify() of attempt %d error = %v", attempt, err)
+		}
+
+		read, err := io.ReadAll(req.Body)
+		if err != nil || !bytes.Equal(read, body) {
+			t.Errorf("request body after Verify() = %q, %v, want %q", read, err, body)
+		}
+	}
+}
+
+func TestEndpointSigner(t *testing.T) {
+	a := newTestApi(t, map[string]interface{}{
+		"/api/v1/namespaces/signed":   testNamespace("signed", map[string]string{defaultSigningSecretAnnotation: "amp-signing"}),
+		"/api/v1/namespaces/unsigned": testNamespace("unsigned", nil),
+		"/api/v1/namespaces/empty":    testNamespace("empty", map[string]string{defaultSigningSecretAnnotation: "amp-signing"}),
+		"/api/v1/namespaces/signed/secrets/amp-signing": &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "amp-signing", Namespace: "signed"},
+			Data:       map[string][]byte{SigningKeySecretKey: []byte("key")},
+		},
+		"/api/v1/namespaces/empty/secrets/amp-signing": &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "amp-signing", Namespace: "empty"},
+		},
+	})
+
+	tests := []struct {
+		namespace  string
+		wantSigner bool
+		wantErr    bool
+	}{
+		{namespace: "signed", wantSigner: true},
+		{namespace: "unsigned"},
+		{namespace: "empty", wantErr: true},
+		{namespace: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		req := &admissionv1.AdmissionRequest{UID: "uid", Namespace: tt.namespace}
+
+		s, err := a.endpointSigner(context.Background(), req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("endpointSigner(%q) error = %v, wantErr %v", tt.namespace, err, tt.wantErr)
+			continue
+		}
+		if (s != nil) != tt.wantSigner {
+			t.Errorf("endpointSigner(%q) = %v, want a signer %v", tt.namespace, s, tt.wantSigner)
+		}
+	}
+}
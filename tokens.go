@@ -0,0 +1,242 @@
+package amp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultTokenExpiration  = time.Hour
+	defaultTokenFileRefresh = time.Minute
+)
+
+// TokenSource provides the bearer tokens sent to endpoints.
+type TokenSource interface {
+	// Token returns a token for audience.
+	Token(ctx context.Context, audience string) (string, error)
+}
+
+// FileTokenSource reads a projected ServiceAccount token from Path.
+// The kubelet rotates the file, it is re-read every minute. The
+// audience of the token is fixed by the projection, Token fails for
+// any audience other than Audience.
+type FileTokenSource struct {
+	Path     string
+	Audience string
+
+	mu    sync.Mutex
+	token string
+	read  time.Time
+}
+
+// NewFileTokenSource returns a FileTokenSource for the token projected
+// to path with audience.
+func NewFileTokenSource(path string, audience string) *FileTokenSource {
+	return &FileTokenSource{Path: path, Audience: audience}
+}
+
+func (fts *FileTokenSource) Token(ctx context.Context, audience string) (string, error) {
+	if audience != fts.Audience {
+		return "", fmt.Errorf("token file %s is projected for audience %q, not %q", fts.Path, fts.Audience, audience)
+	}
+
+	fts.mu.Lock()
+	defer fts.mu.Unlock()
+
+	if fts.token != "" && time.Since(fts.read) < defaultTokenFileRefresh {
+		return fts.token, nil
+	}
+
+	data, err := os.ReadFile(fts.Path)
+	if err != nil {
+		return "", err
+	}
+
+	token := string(bytes.TrimSpace(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", fts.Path)
+	}
+	fts.token, fts.read = token, time.Now()
+
+	return token, nil
+}
+
+type requestedToken struct {
+	token   string
+	refresh time.Time
+}
+
+// TokenRequestSource requests tokens for the ServiceAccount Name in
+// Namespace with the TokenRequest API. Tokens are cached per audience
+// and renewed once 80% of their lifetime has passed.
+type TokenRequestSource struct {
+	Cs         kubernetes.Interface
+	Namespace  string
+	Name       string
+	Expiration time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]requestedToken
+}
+
+// NewTokenRequestSource returns a TokenRequestSource for the
+// ServiceAccount name in namespace requesting tokens valid for
+// expiration, defaults to one hour.
+func NewTokenRequestSource(cs kubernetes.Interface, namespace string, name string, expiration time.Duration) *TokenRequestSource {
+	if expiration == 0 {
+		expiration = defaultTokenExpiration
+	}
+
+	return &TokenRequestSource{
+		Cs:         cs,
+		Namespace:  namespace,
+		Name:       name,
+		Expiration: expiration,
+		tokens:     map[string]requestedToken{},
+	}
+}
+
+func (trs *TokenRequestSource) Token(ctx context.Context, audience string) (string, error) {
+	trs.mu.Lock()
+	cached, ok := trs.tokens[audience]
+	trs.mu.Unlock()
+
+	if ok && time.Now().Before(cached.refresh) {
+		return cached.token, nil
+	}
+
+	seconds := int64(trs.Expiration / time.Second)
+	tr, err := trs.Cs.CoreV1().ServiceAccounts(trs.Namespace).CreateToken(ctx, trs.Name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{audience},
+			ExpirationSeconds: &seconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		// keep using a cached token that has not expired yet
+		if ok && time.Now().Before(cached.refresh.Add(trs.Expiration/5)) {
+			return cached.token, nil
+		}
+		return "", fmt.Errorf("unable to request token for %s/%s: %w", trs.Namespace, trs.Name, err)
+	}
+
+	issued := time.Now()
+	lifetime := tr.Status.ExpirationTimestamp.Sub(issued)
+	if lifetime <= 0 {
+		lifetime = trs.Expiration
+	}
+
+	trs.mu.Lock()
+	trs.tokens[audience] = requestedToken{
+		token:   tr.Status.Token,
+		refresh: issued.Add(lifetime * 4 / 5),
+	}
+	trs.mu.Unlock()
+
+	return tr.Status.Token, nil
+}
+
+type tokenAudienceKey struct{}
+
+// withTokenAudience returns a context requesting a bearer token for
+// audience from a TokenTransport.
+func withTokenAudience(ctx context.Context, audience string) context.Context {
+	return context.WithValue(ctx, tokenAudienceKey{}, audience)
+}
+
+// TokenTransport adds an Authorization bearer token from Tokens to
+// endpoint requests that have a token audience, as chosen per
+// namespace by Api. Requests without an audience are sent as is.
+type TokenTransport struct {
+	T      http.RoundTripper
+	Tokens TokenSource
+}
+
+// NewTokenTransport returns a TokenTransport calling through t,
+// http.DefaultTransport when nil.
+func NewTokenTransport(t http.RoundTripper, tokens TokenSource) *TokenTransport {
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	return &TokenTransport{T: t, Tokens: tokens}
+}
+
+func (tt *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	audience, _ := req.Context().Value(tokenAudienceKey{}).(string)
+	if audience == "" || tt.Tokens == nil {
+		return tt.T.RoundTrip(req)
+	}
+
+	token, err := tt.Tokens.Token(req.Context(), audience)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get bearer token: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return tt.T.RoundTrip(req)
+}
+
+func (tt *TokenTransport) CloseIdleConnections() {
+	closeIdleConnections(tt.T)
+}
+
+// tokenAudience returns the bearer token audience for the endpoint
+// calls of namespace. A namespace may choose an audience with
+// TokenAudienceAnnotation if it matches one of AllowedTokenAudiences,
+// otherwise TokenAudience is used. A namespace that can not be read
+// is an error rather than falling back to TokenAudience.
+func (a *Api) tokenAudience(ctx context.Context, namespace string, logInfo []zap.Field) (string, error) {
+	if namespace == "" {
+		return a.TokenAudience, nil
+	}
+
+	ns, err := a.GetNamespace(ctx, namespace)
+	if err != nil {
+		return "", fmt.Errorf("unable to get namespace %s for %s: %w", namespace, a.TokenAudienceAnnotation, err)
+	}
+
+	audience, ok := ns.GetAnnotations()[a.TokenAudienceAnnotation]
+	if !ok {
+		return a.TokenAudience, nil
+	}
+
+	if !audienceAllowed(audience, namespace, a.AllowedTokenAudiences) {
+		a.Log.Warn("namespace token audience not allowed",
+			append(logInfo, zap.String("audience", audience))...,
+		)
+		return "", fmt.Errorf("token audience %q is not allowed for namespace %s", audience, namespace)
+	}
+
+	return audience, nil
+}
+
+// audienceAllowed reports whether audience matches one of the glob
+// patterns, "{namespace}" in a pattern is replaced by namespace.
+func audienceAllowed(audience string, namespace string, patterns []string) bool {
+	if audience == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ReplaceAll(pattern, "{namespace}", namespace)
+		if ok, err := path.Match(pattern, audience); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,40 @@
+package amp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTokenAudience(t *testing.T) {
+	a := newTestApi(t, map[string]interface{}{
+		"/api/v1/namespaces/team-a": testNamespace("team-a", map[string]string{defaultTokenAudienceAnnotation: "amp-team-a"}),
+		"/api/v1/namespaces/team-b": testNamespace("team-b", nil),
+		"/api/v1/namespaces/team-c": testNamespace("team-c", map[string]string{defaultTokenAudienceAnnotation: "amp-team-a"}),
+	})
+	a.TokenAudience = "amp"
+	a.TokenAudienceAnnotation = defaultTokenAudienceAnnotation
+	a.AllowedTokenAudiences = []string{"amp-{namespace}"}
+
+	tests := []struct {
+		namespace string
+		want      string
+		wantErr   bool
+	}{
+		{namespace: "", want: "amp"},
+		{namespace: "team-a", want: "amp-team-a"},
+		{namespace: "team-b", want: "amp"},
+		{namespace: "team-c", wantErr: true},
+		{namespace: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := a.tokenAudience(context.Background(), tt.namespace, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("tokenAudience(%q) error = %v, wantErr %v", tt.namespace, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("tokenAudience(%q) = %q, want %q", tt.namespace, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package amp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Aggregation decides how many validation endpoints must allow an
+// object for it to be admitted: "all", "any" or a quorum count N.
+type Aggregation string
+
+const (
+	AggregationAll Aggregation = "all"
+	AggregationAny Aggregation = "any"
+)
+
+// ParseAggregation parses an aggregation mode.
+func ParseAggregation(value string) (Aggregation, error) {
+	agg := Aggregation(strings.ToLower(strings.TrimSpace(value)))
+	if agg == AggregationAll || agg == AggregationAny {
+		return agg, nil
+	}
+
+	n, err := strconv.Atoi(string(agg))
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("invalid aggregation %q, expected all, any or a positive quorum count", value)
+	}
+
+	return agg, nil
+}
+
+// required returns how many of total endpoints must allow.
+func (agg Aggregation) required(total int) int {
+	switch agg {
+	case AggregationAny:
+		return 1
+	case AggregationAll, "":
+		return total
+	}
+
+	n, _ := strconv.Atoi(string(agg))
+	return n
+}
+
+// capped returns agg for the votes left after ignored failures are
+// dropped, a quorum larger than votes requires all of them so ignored
+// endpoints can not deny by falling short of the quorum.
+func (agg Aggregation) capped(votes int) Aggregation {
+	if agg.required(votes) > votes {
+		return AggregationAll
+	}
+
+	return agg
+}
+
+// validationResult is the outcome of a single validation endpoint.
+type validationResult struct {
+	ep       Endpoint
+	response admissionv1.AdmissionResponse
+	err      error
+}
+
+// callValidationEndpoints calls every endpoint concurrently with the
+// object under review.
+func (a *Api) callValidationEndpoints(ctx context.Context, req *admissionv1.AdmissionRequest, eps []Endpoint, logInfo []zap.Field) []validationResult {
+	results := make([]validationResult, len(eps))
+
+	var wg sync.WaitGroup
+	for i, ep := range eps {
+		wg.Add(1)
+		go func(i int, ep Endpoint) {
+			defer wg.Done()
+
+			epLog := append(logInfo[:len(logInfo):len(logInfo)],
+				zap.String("endpoint", ep.URL),
+				zap.String("source", ep.Source),
+			)
+
+			results[i].ep = ep
+
+			var body []byte
+			sentReq, sent, err := a.projectRequest(ep, req, req.Object.Raw)
+			if err == nil {
+				body, err = a.endpointPayload(ctx, ep, sentReq, sent)
+			}
+			if err != nil {
+				a.Log.Error("unable to build endpoint payload",
+					append(epLog, zap.Error(err))...,
+				)
+				results[i].err = &EndpointError{Endpoint: ep.URL, Class: FailureResolution, Err: fmt.Errorf("unable to build endpoint payload: %w", err)}
+				return
+			}
+
+			respBody, _, err := a.callEndpoint(ctx, ep, body, epLog)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+
+			if ep.Format == PayloadAdmissionReview {
+				resp, err := admissionReviewResponse(respBody)
+				if err != nil {
+					a.Log.Error("unable to read endpoint AdmissionReview",
+						append(epLog, zap.Error(err))...,
+					)
+					results[i].err = &EndpointError{Endpoint: ep.URL, Class: FailureBody, Err: err}
+					return
+				}
+				results[i].response = *resp
+				return
+			}
+
+			// unmarshal response body into admissionv1.AdmissionResponse
+			err = json.Unmarshal(respBody, &results[i].response)
+			if err != nil {
+				a.Log.Error("unable to unmarshal response body into admissionv1.AdmissionResponse",
+					append(epLog, zap.Error(err))...,
+				)
+				results[i].err = &EndpointError{Endpoint: ep.URL, Class: FailureBody, Err: fmt.Errorf("unable to unmarshal response body into admissionv1.AdmissionResponse: %w", err)}
+			}
+		}(i, ep)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// aggregate combines validation results into a single response,
+// merging the denial messages of every endpoint that did not allow.
+// The response of a single endpoint that alone decides is returned as
+// is. Failed results are expected to carry the status set by the
+// failure policy.
+func aggregate(agg Aggregation, results []validationResult) *admissionv1.AdmissionResponse {
+	required := agg.required(len(results))
+
+	if len(results) == 1 && required == 1 {
+		if results[0].err != nil && results[0].response.Result == nil {
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Code:    http.StatusInternalServerError,
+					Message: fmt.Sprintf("validatePod %s", results[0].err.Error()),
+				},
+			}
+		}
+		return &results[0].response
+	}
+
+	reviewResponse := &admissionv1.AdmissionResponse{}
+
+	allowed := 0
+	var denials []string
+	var code int32
+	for _, r := range results {
+		mergeResponseMeta(reviewResponse, &r.response)
+
+		if r.err != nil {
+			msg := r.err.Error()
+			if r.response.Result != nil {
+				msg = r.response.Result.Message
+			}
+			denials = append(denials, msg)
+			if code == 0 {
+				code = http.StatusInternalServerError
+			}
+			continue
+		}
+
+		if r.response.Allowed {
+			allowed++
+			continue
+		}
+
+		msg := "denied"
+		if r.response.Result != nil {
+			if r.response.Result.Message != "" {
+				msg = r.response.Result.Message
+			}
+			if code == 0 || code == http.StatusInternalServerError {
+				code = r.response.Result.Code
+			}
+		}
+		denials = append(denials, fmt.Sprintf("%s: %s", r.ep.URL, msg))
+	}
+
+	if allowed >= required {
+		reviewResponse.Allowed = true
+		return reviewResponse
+	}
+
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+
+	reviewResponse.Result = &metav1.Status{
+		Code: code,
+		Message: fmt.Sprintf("validatePod %d of %d endpoints allowed, %d required: %s",
+			allowed, len(results), required, strings.Join(denials, "; ")),
+	}
+
+	return reviewResponse
+}
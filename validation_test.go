@@ -0,0 +1,96 @@
+package amp
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseAggregation(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Aggregation
+		wantErr bool
+	}{
+		{value: "all", want: AggregationAll},
+		{value: " Any ", want: AggregationAny},
+		{value: "2", want: "2"},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "most", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAggregation(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAggregation(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseAggregation(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	allow := validationResult{response: admissionv1.AdmissionResponse{Allowed: true}}
+	deny := validationResult{response: admissionv1.AdmissionResponse{
+		Result: &metav1.Status{Code: http.StatusForbidden, Message: "denied"},
+	}}
+	failed := validationResult{err: errors.New("unreachable")}
+
+	tests := []struct {
+		name    string
+		agg     Aggregation
+		results []validationResult
+		want    bool
+	}{
+		{name: "single allow", agg: AggregationAll, results: []validationResult{allow}, want: true},
+		{name: "single deny", agg: AggregationAny, results: []validationResult{deny}, want: false},
+		{name: "single failure", agg: AggregationAll, results: []validationResult{failed}, want: false},
+		{name: "single below quorum", agg: "2", results: []validationResult{allow}, want: false},
+		{name: "all allow", agg: AggregationAll, results: []validationResult{allow, allow}, want: true},
+		{name: "all with deny", agg: AggregationAll, results: []validationResult{allow, deny}, want: false},
+		{name: "any with deny", agg: AggregationAny, results: []validationResult{deny, allow}, want: true},
+		{name: "any with failure", agg: AggregationAny, results: []validationResult{failed, deny}, want: false},
+		{name: "quorum reached", agg: "2", results: []validationResult{allow, deny, allow}, want: true},
+		{name: "quorum missed", agg: "2", results: []validationResult{allow, deny, failed}, want: false},
+		{name: "quorum above endpoints", agg: "3", results: []validationResult{allow, allow}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := aggregate(tt.agg, tt.results)
+			if resp.Allowed != tt.want {
+				t.Errorf("aggregate(%q) allowed = %v, want %v", tt.agg, resp.Allowed, tt.want)
+			}
+			if !resp.Allowed && resp.Result == nil {
+				t.Errorf("aggregate(%q) denied without a result", tt.agg)
+			}
+		})
+	}
+}
+
+func TestAggregationCapped(t *testing.T) {
+	tests := []struct {
+		agg   Aggregation
+		votes int
+		want  Aggregation
+	}{
+		{agg: AggregationAny, votes: 1, want: AggregationAny},
+		{agg: AggregationAll, votes: 2, want: AggregationAll},
+		{agg: "2", votes: 3, want: "2"},
+		{agg: "2", votes: 2, want: "2"},
+		{agg: "2", votes: 1, want: AggregationAll},
+		{agg: "3", votes: 2, want: AggregationAll},
+	}
+
+	for _, tt := range tests {
+		if got := tt.agg.capped(tt.votes); got != tt.want {
+			t.Errorf("Aggregation(%q).capped(%d) = %q, want %q", tt.agg, tt.votes, got, tt.want)
+		}
+	}
+}